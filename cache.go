@@ -9,35 +9,20 @@ import (
 	"time"
 	"os"
 	"errors"
+	"strconv"
 
 	"github.com/boltdb/bolt"
 )
 
+// FileCacheEntry records which bytes of one version of a file, identified by its etag and size, are
+// in the local file
 type FileCacheEntry struct {
-	LocalPath string
-	Valid     *RegionSet
-}
-
-type RegionSet struct {
-	Regions []Region
-}
-
-// dumb implementation
-func (rs *RegionSet) add(region Region) {
-	rs.Regions = append(rs.Regions, region)
-}
-
-func (rs *RegionSet) firstMissing(region Region) *Region {
-	remainder := &region
-
-	for _, r := range rs.Regions {
-		remainder = remainder.FirstNonOverlap(&r)
-		if remainder == nil {
-			return nil
-		}
-	}
-
-	return remainder
+	LocalPath  string
+	Etag       string
+	Size       uint64
+	Valid      *RegionSet
+	LastAccess int64
+	Checksums  *BlockChecksums
 }
 
 type DirEntries struct {
@@ -56,22 +41,75 @@ func (f *DirEntries) Get(name string) *FileStat {
 
 const FILE_MAP = "files"
 const DIR_MAP = "dirs"
+const META = "meta"
+
+// PENDING_DELETE holds the local files of entries which were replaced, until they have been deleted
+const PENDING_DELETE = "pending"
+
+// CACHE_VERSION is bumped whenever the layout of records in the bolt database changes.  Version 2
+// requires the regions in each FileCacheEntry to be sorted and merged.  Version 3 records the etag
+// and size of each FileCacheEntry; older entries have neither, so they are replaced when next used.
+const CACHE_VERSION = 3
+
+var versionKey = []byte("version")
 
+// Cache keeps the bytes of one version of each file, identified by its etag.  Region methods called
+// with an etag other than the cached version's treat the file as not in the cache.
 type Cache interface {
-	GetLocalFile(path string, length uint64) (string, error)
-	EvictFile(path string) error
-	GetFirstMissingRegion(path string, offset uint64, length uint64) *Region
-	AddedRegions(path string, offset uint64, length uint64)
+	GetLocalFile(path string, etag string, length uint64) (string, error)
+	// EvictFile removes the cached copy of path if it is the version with etag, or any version if etag is ""
+	EvictFile(path string, etag string) error
+	// EvictClosedFile is EvictFile, but fails with FileIsOpen instead of evicting a file which is open
+	EvictClosedFile(path string, etag string) error
+	GetFirstMissingRegion(path string, etag string, offset uint64, length uint64) *Region
+	GetMissingRegions(path string, etag string, offset uint64, length uint64) ([]Region, error)
+	PeekMissingRegions(path string, etag string, offset uint64, length uint64) ([]Region, error)
+	// AddedRegions records that a region of the local file has been filled in
+	AddedRegions(path string, etag string, offset uint64, length uint64) error
+	GetChecksums(path string, etag string) (*BlockChecksums, error)
+	AddChecksums(path string, etag string, checksums *BlockChecksums) error
 
 	GetListDir(path string) (*DirEntries, error)
 	PutListDir(path string, files *DirEntries) error
 	Invalidate(path string) error
+	// InvalidateRecursive marks the listings of path and every directory below it stale.  The root's
+	// path is "", so invalidating it marks every listing stale.
+	InvalidateRecursive(path string) (int, error)
+
+	// FileOpened and FileClosed bracket the lifetime of a FileHandle.  Files which are open are never evicted.
+	FileOpened(path string)
+	FileClosed(path string)
+
+	// Pinned files are never evicted either.  Pins persist until they are removed.
+	Pin(path string) error
+	PinTree(path string) error
+	Unpin(path string, recursive bool) (int, error)
+	PinnedBytes() (uint64, error)
+
+	CachedFiles(path string, recursive bool) ([]*CachedFile, error)
+	DropListDirs(path string, recursive bool) (int, error)
 }
 
 type LocalCache struct {
 	rootDir string
 	lock    sync.Mutex
 	db      *bolt.DB
+
+	open     map[string]int
+	accessed map[string]int64
+
+	policy       EvictionPolicy
+	stats        *Stats
+	evictTrigger chan bool
+	stop         chan bool
+
+	durability  Durability
+	unsynced    map[string]*unsyncedRegions
+	flushing    map[string]*unsyncedRegions
+	flushLock   sync.Mutex
+	sync        func(localPath string) error
+	batcherStop chan bool
+	batcherDone chan bool
 }
 
 func NewLocalCache(rootDir string) (*LocalCache, error) {
@@ -87,22 +125,160 @@ func NewLocalCache(rootDir string) (*LocalCache, error) {
 			return err
 		}
 		_, err = tx.CreateBucketIfNotExists([]byte(DIR_MAP))
-		return err
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte(META))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte(PENDING_DELETE))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte(PINS))
+		if err != nil {
+			return err
+		}
+		return migrate(tx)
 	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	return &LocalCache{rootDir: rootDir, db: db}, nil
+	c := &LocalCache{rootDir: rootDir,
+		db:           db,
+		open:         make(map[string]int),
+		accessed:     make(map[string]int64),
+		evictTrigger: make(chan bool, 1),
+		stop:         make(chan bool),
+		unsynced:     make(map[string]*unsyncedRegions),
+		sync:         syncFile}
+
+	// finish deleting anything left over from before a crash
+	err = c.deletePending()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func decodeFileCacheEntry(entryBytes []byte) (*FileCacheEntry, error) {
+	var e FileCacheEntry
+	dec := gob.NewDecoder(bytes.NewBuffer(entryBytes))
+	err := dec.Decode(&e)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func encodeFileCacheEntry(e *FileCacheEntry) ([]byte, error) {
+	buffer := bytes.NewBuffer(make([]byte, 0, 100))
+	enc := gob.NewEncoder(buffer)
+	err := enc.Encode(e)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// migrate brings the records in a database written by an older version up to CACHE_VERSION
+func migrate(tx *bolt.Tx) error {
+	meta := tx.Bucket([]byte(META))
+	version := 1
+	if value := meta.Get(versionKey); value != nil {
+		var err error
+		version, err = strconv.Atoi(string(value))
+		if err != nil {
+			return err
+		}
+	}
+
+	if version > CACHE_VERSION {
+		return errors.New(fmt.Sprintf("Cache was written by a newer version (%d > %d)", version, CACHE_VERSION))
+	}
+
+	if version < 2 {
+		b := tx.Bucket([]byte(FILE_MAP))
+		updated := make(map[string][]byte)
+		err := b.ForEach(func(k, v []byte) error {
+			e, err := decodeFileCacheEntry(v)
+			if err != nil {
+				return err
+			}
+			if e.Valid.normalize() {
+				encoded, err := encodeFileCacheEntry(e)
+				if err != nil {
+					return err
+				}
+				updated[string(k)] = encoded
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for k, v := range updated {
+			err = b.Put([]byte(k), v)
+			if err != nil {
+				return err
+			}
+		}
+		fmt.Printf("Migrated %d cache entries to version %d\n", len(updated), CACHE_VERSION)
+	}
+
+	return meta.Put(versionKey, []byte(strconv.Itoa(CACHE_VERSION)))
+}
+
+func (c *LocalCache) Close() error {
+	close(c.stop)
+	c.lock.Lock()
+	batcherDone := c.batcherDone
+	c.lock.Unlock()
+	if batcherDone != nil {
+		<-batcherDone
+	}
+	err := c.flushUnsynced()
+	if err != nil {
+		fmt.Printf("committing regions failed: %s\n", err.Error())
+	}
+	return c.db.Close()
+}
+
+func (c *LocalCache) FileOpened(path string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.open[path] += 1
+	c.accessed[path] = time.Now().UnixNano()
+}
+
+func (c *LocalCache) FileClosed(path string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.open[path] -= 1
+	if c.open[path] <= 0 {
+		delete(c.open, path)
+	}
 }
 
 var NotInCache error = errors.New("File not in cache")
 
-func (c *LocalCache) EvictFile(path string) error {
+func (c *LocalCache) EvictFile(path string, etag string) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	return c.evictFile(path, etag)
+}
+
+// evictFile is EvictFile.  Must be called with lock held.
+func (c *LocalCache) evictFile(path string, etag string) error {
 	localPath := ""
 
 	err := c.db.Update(func(tx *bolt.Tx) error {
@@ -119,9 +295,15 @@ func (c *LocalCache) EvictFile(path string) error {
 				return err
 			}
 
+			if etag != "" && e.Etag != etag {
+				return nil
+			}
+
 			localPath = e.LocalPath
 			
 			b.Delete(key)
+			delete(c.accessed, path)
+			c.forgetUnsynced(path)
 		}
 		return nil
 	})
@@ -138,117 +320,203 @@ func (c *LocalCache) EvictFile(path string) error {
 	return err
 }
 
-func (c *LocalCache) GetLocalFile(path string, length uint64) (string, error) {
+// GetLocalFile returns the local file for the version of path with the given etag and length,
+// creating an empty one if there is none.  If the cached copy of path is some other version, it is
+// replaced with a fresh entry and the old local file is deleted.
+func (c *LocalCache) GetLocalFile(path string, etag string, length uint64) (string, error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
 	var localPath string
 	localPath = ""
+	replaced := false
 
 	err := c.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(FILE_MAP))
 		key := []byte(path)
 		entryBytes := b.Get(key)
-		if entryBytes == nil {
-			var err error
-			localFile, err := ioutil.TempFile(c.rootDir, "l")
-			localPath = localFile.Name()
-			fmt.Printf("Created local file: %s\n", localPath)
-			localFile.Close()
+		if entryBytes != nil {
+			e, err := decodeFileCacheEntry(entryBytes)
 			if err != nil {
 				return err
 			}
 
-			buffer := bytes.NewBuffer(make([]byte, 0, 100))
-			enc := gob.NewEncoder(buffer)
-			e := &FileCacheEntry{LocalPath: localPath, Valid: &RegionSet{Regions: make([]Region, 0)}}
-			err = enc.Encode(e)
+			if e.Etag == etag && e.Size == length {
+				localPath = e.LocalPath
+				return nil
+			}
+
+			// the old local file is deleted once this transaction has committed
+			fmt.Printf("Replacing cached copy of %s (etag: %s, size: %d) with etag: %s, size: %d\n", path, e.Etag, e.Size, etag, length)
+			err = tx.Bucket([]byte(PENDING_DELETE)).Put([]byte(e.LocalPath), key)
 			if err != nil {
 				return err
 			}
+			c.forgetUnsynced(path)
+			replaced = true
+		}
 
-			bb := buffer.Bytes()
-			b.Put(key, bb)
+		localFile, err := ioutil.TempFile(c.rootDir, "l")
+		if err != nil {
+			return err
+		}
+		localPath = localFile.Name()
+		fmt.Printf("Created local file: %s\n", localPath)
+		localFile.Close()
 
-			fmt.Printf("e=%s, writing %s -> len(): %d\n", e, key, len(bb))
-		} else {
-			var e FileCacheEntry
+		e := &FileCacheEntry{LocalPath: localPath, Etag: etag, Size: length, Valid: &RegionSet{Regions: make([]Region, 0)}, LastAccess: time.Now().UnixNano()}
+		encoded, err := encodeFileCacheEntry(e)
+		if err != nil {
+			return err
+		}
 
-			buffer := bytes.NewBuffer(entryBytes)
-			dec := gob.NewDecoder(buffer)
-			err := dec.Decode(&e)
+		return b.Put(key, encoded)
+	})
+
+	if err == nil && replaced {
+		err = c.deletePending()
+	}
+
+	return localPath, err
+}
+
+// deletePending deletes the local files of entries which were replaced.  They are recorded in the same
+// transaction which replaces the entry, so none are leaked if the process dies before deleting them.
+func (c *LocalCache) deletePending() error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(PENDING_DELETE))
+		deleted := make([][]byte, 0)
+		err := b.ForEach(func(k, v []byte) error {
+			err := os.Remove(string(k))
+			if err != nil && !os.IsNotExist(err) {
+				fmt.Printf("Could not delete %s, will try again later: %s\n", string(k), err.Error())
+				return nil
+			}
+			deleted = append(deleted, append([]byte(nil), k...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range deleted {
+			err = b.Delete(k)
 			if err != nil {
 				return err
 			}
-
-			localPath = e.LocalPath
 		}
 		return nil
 	})
+}
 
-	return localPath, err
+func (c *LocalCache) GetFirstMissingRegion(path string, etag string, offset uint64, length uint64) *Region {
+	missing, err := c.GetMissingRegions(path, etag, offset, length)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+	return &missing[0]
+}
+
+func (c *LocalCache) GetMissingRegions(path string, etag string, offset uint64, length uint64) ([]Region, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.accessed[path] = time.Now().UnixNano()
+
+	return c.missingRegions(path, etag, offset, length)
 }
 
-func (c *LocalCache) GetFirstMissingRegion(path string, offset uint64, length uint64) *Region {
-	fmt.Printf("GetFirstMissingRegion(\"%s\", %d, %d)\n",  path, offset, length)
+// PeekMissingRegions is GetMissingRegions without counting as a read of the file, so looking doesn't
+// change which files are evicted first
+func (c *LocalCache) PeekMissingRegions(path string, etag string, offset uint64, length uint64) ([]Region, error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	var missing *Region
+	return c.missingRegions(path, etag, offset, length)
+}
+
+// missingRegions must be called with lock held
+func (c *LocalCache) missingRegions(path string, etag string, offset uint64, length uint64) ([]Region, error) {
+	var missing []Region
 
 	err := c.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(FILE_MAP))
-		key := []byte(path)
-		entryBytes := b.Get(key)
-//		fmt.Printf("in cache, fetched len %d for \"%s\"\n", len(entryBytes), path)
-		var e FileCacheEntry
+		entryBytes := b.Get([]byte(path))
+		if entryBytes == nil {
+			return NotInCache
+		}
 
-		buffer := bytes.NewBuffer(entryBytes)
-		dec := gob.NewDecoder(buffer)
-		err := dec.Decode(&e)
+		e, err := decodeFileCacheEntry(entryBytes)
 		if err != nil {
 			return err
 		}
+		if e.Etag != etag {
+			return NotInCache
+		}
 
-		missing = e.Valid.firstMissing(Region{offset, length})
+		missing = c.withUnsynced(path, etag, e.Valid.missing(Region{offset, length}))
 
 		return nil
 	})
 
-	if err != nil {
-		panic(err.Error())
-	}
-
-	return missing
+	return missing, err
 }
 
-func (c *LocalCache) AddedRegions(path string, offset uint64, length uint64) {
+func (c *LocalCache) AddedRegions(path string, etag string, offset uint64, length uint64) error {
 	c.lock.Lock()
-	defer c.lock.Unlock()
-
-	c.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(FILE_MAP))
-		key := []byte(path)
-		entryBytes := b.Get(key)
-		var e FileCacheEntry
-
-		buffer := bytes.NewBuffer(entryBytes)
-		dec := gob.NewDecoder(buffer)
-		dec.Decode(&e)
+	durability := c.durability
+	if durability == DurabilityBatched {
+		pending := c.unsynced[path]
+		if pending == nil || pending.etag != etag {
+			pending = &unsyncedRegions{etag: etag}
+			c.unsynced[path] = pending
+		}
+		pending.regions.add(Region{offset, length})
+		c.lock.Unlock()
+		return nil
+	}
 
-		e.Valid.add(Region{offset, length})
+	localPath, err := c.localPathOf(path, etag)
+	c.lock.Unlock()
+	if err == NotInCache {
+		// evicted or replaced while the region was being fetched
+		return nil
+	} else if err != nil {
+		return err
+	}
 
-		buffer = bytes.NewBuffer(make([]byte, 0, 100))
-		enc := gob.NewEncoder(buffer)
-		enc.Encode(e)
+	// fsync can take a long time, so it's done without holding the lock.  recordRegions checks the
+	// file wasn't replaced meanwhile.
+	if durability == DurabilityRegion {
+		err = c.sync(localPath)
+		if err != nil {
+			return err
+		}
+	}
 
-		b.Put(key, buffer.Bytes())
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-		return nil
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		return c.recordRegions(tx, path, etag, localPath, []Region{{offset, length}})
 	})
+	if err != nil {
+		return err
+	}
+
+	c.requestEviction()
+	return nil
 }
 
 func (c *LocalCache) Invalidate(path string) error {
+	if path == "" {
+		path = "/"
+	}
+
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	
@@ -278,6 +546,56 @@ func (c *LocalCache) Invalidate(path string) error {
 	return err
 }
 
+func (c *LocalCache) InvalidateRecursive(path string) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	invalidated := 0
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(DIR_MAP))
+
+		stale := make(map[string]*DirEntries)
+		err := b.ForEach(func(k, v []byte) error {
+			key := string(k)
+			if key == "/" {
+				key = ""
+			}
+			if !underPath(key, path, true) {
+				return nil
+			}
+
+			var files DirEntries
+			dec := gob.NewDecoder(bytes.NewBuffer(v))
+			err := dec.Decode(&files)
+			if err != nil {
+				return err
+			}
+			files.Valid = false
+			stale[string(k)] = &files
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// bolt doesn't allow changes while iterating, so the updates are written afterwards
+		for key, files := range stale {
+			buffer := bytes.NewBuffer(make([]byte, 0, 100))
+			err = gob.NewEncoder(buffer).Encode(files)
+			if err != nil {
+				return err
+			}
+			err = b.Put([]byte(key), buffer.Bytes())
+			if err != nil {
+				return err
+			}
+		}
+		invalidated = len(stale)
+		return nil
+	})
+	return invalidated, err
+}
+
 func (c *LocalCache) GetListDir(path string) (*DirEntries, error) {
 	if path == "" {
 		path = "/"
@@ -2,8 +2,12 @@ package singleply
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 
+	"github.com/boltdb/bolt"
 	. "gopkg.in/check.v1"
 )
 
@@ -38,52 +42,169 @@ func (s *CacheSuite) TestRegionSet(c *C) {
 
 }
 
+func (s *CacheSuite) TestRegionSetCoalesces(c *C) {
+	var rs RegionSet
+
+	// simulate a file read in small chunks, out of order
+	for i := 9; i >= 0; i-- {
+		rs.add(Region{uint64(i * 10), 10})
+	}
+	c.Assert(rs.Regions, DeepEquals, []Region{{0, 100}})
+
+	rs.add(Region{200, 50})
+	rs.add(Region{150, 10})
+	rs.add(Region{120, 10})
+	c.Assert(rs.Regions, DeepEquals, []Region{{0, 100}, {120, 10}, {150, 10}, {200, 50}})
+
+	// bridging several regions merges them
+	rs.add(Region{125, 30})
+	c.Assert(rs.Regions, DeepEquals, []Region{{0, 100}, {120, 40}, {200, 50}})
+
+	c.Assert(rs.missing(Region{50, 250}), DeepEquals, []Region{{100, 20}, {160, 40}, {250, 50}})
+	c.Assert(rs.missing(Region{130, 20}), DeepEquals, []Region{})
+	c.Assert(rs.missing(Region{90, 40}), DeepEquals, []Region{{100, 20}})
+	c.Assert(rs.firstMissing(Region{0, 100}), IsNil)
+}
+
+func (s *CacheSuite) TestMigratesRegionSets(c *C) {
+	dir := c.MkDir()
+	cache, err := NewLocalCache(dir)
+	c.Assert(err, IsNil)
+
+	_, err = cache.GetLocalFile("x", "1", 100)
+	c.Assert(err, IsNil)
+
+	// write an entry the way older versions did: unsorted and overlapping, with no version recorded
+	err = cache.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(FILE_MAP))
+		e, err := decodeFileCacheEntry(b.Get([]byte("x")))
+		c.Assert(err, IsNil)
+		e.Valid.Regions = []Region{{40, 20}, {0, 10}, {5, 10}, {60, 5}}
+		encoded, err := encodeFileCacheEntry(e)
+		c.Assert(err, IsNil)
+		b.Put([]byte("x"), encoded)
+		return tx.Bucket([]byte(META)).Delete(versionKey)
+	})
+	c.Assert(err, IsNil)
+	cache.Close()
+
+	cache, err = NewLocalCache(dir)
+	c.Assert(err, IsNil)
+	defer cache.Close()
+
+	cache.db.View(func(tx *bolt.Tx) error {
+		e, err := decodeFileCacheEntry(tx.Bucket([]byte(FILE_MAP)).Get([]byte("x")))
+		c.Assert(err, IsNil)
+		c.Assert(e.Valid.Regions, DeepEquals, []Region{{0, 15}, {40, 25}})
+		return nil
+	})
+
+	missing, err := cache.GetMissingRegions("x", "1", 0, 100)
+	c.Assert(err, IsNil)
+	c.Assert(missing, DeepEquals, []Region{{15, 25}, {65, 35}})
+}
+
 func (s *CacheSuite) TestLocalFiles(c *C) {
 	cache, err := NewLocalCache(c.MkDir())
 	c.Assert(err, IsNil)
 
-	local, err := cache.GetLocalFile("x/y/z", 100)
+	local, err := cache.GetLocalFile("x/y/z", "1", 100)
 	c.Assert(local, Not(Equals), "")
 	c.Assert(err, IsNil)
 
 	// getting local file twice results in same file
-	local2, err := cache.GetLocalFile("x/y/z", 100)
+	local2, err := cache.GetLocalFile("x/y/z", "1", 100)
 	c.Assert(local2, Equals, local)
 	c.Assert(err, IsNil)
 
-	region := cache.GetFirstMissingRegion("x/y/z", 10, 20)
+	region := cache.GetFirstMissingRegion("x/y/z", "1", 10, 20)
 
 	c.Assert(region.str(), Equals, "10:20")
 
-	cache.AddedRegions("x/y/z", 10, 20)
+	cache.AddedRegions("x/y/z", "1", 10, 20)
 
 	// full overlap
-	region = cache.GetFirstMissingRegion("x/y/z", 10, 20)
+	region = cache.GetFirstMissingRegion("x/y/z", "1", 10, 20)
 	c.Assert(region, IsNil)
 
 	// full overlap
-	region = cache.GetFirstMissingRegion("x/y/z", 11, 8)
+	region = cache.GetFirstMissingRegion("x/y/z", "1", 11, 8)
 	c.Assert(region, IsNil)
 
 	// one extra byte before
-	region = cache.GetFirstMissingRegion("x/y/z", 9, 21)
+	region = cache.GetFirstMissingRegion("x/y/z", "1", 9, 21)
 	c.Assert(region.str(), Equals, "9:1")
 
 	// one extra byte after
-	region = cache.GetFirstMissingRegion("x/y/z", 10, 21)
+	region = cache.GetFirstMissingRegion("x/y/z", "1", 10, 21)
 	c.Assert(region.str(), Equals, "30:1")
 
 	// an extra byte before and after
-	region = cache.GetFirstMissingRegion("x/y/z", 9, 22)
+	region = cache.GetFirstMissingRegion("x/y/z", "1", 9, 22)
 	c.Assert(region.str(), Equals, "9:1")
 
 	// register regions (10-30) and (40-60) as populated
-	cache.AddedRegions("x/y/z", 40, 20)
+	cache.AddedRegions("x/y/z", "1", 40, 20)
 
-	region = cache.GetFirstMissingRegion("x/y/z", 29, 12)
+	region = cache.GetFirstMissingRegion("x/y/z", "1", 29, 12)
 	c.Assert(region.str(), Equals, "30:10")
 }
 
+func (s *CacheSuite) TestReplacesOtherVersions(c *C) {
+	dir := c.MkDir()
+	cache, err := NewLocalCache(dir)
+	c.Assert(err, IsNil)
+
+	local1, err := cache.GetLocalFile("x", "1", 100)
+	c.Assert(err, IsNil)
+	cache.AddedRegions("x", "1", 0, 50)
+
+	// other versions don't see the regions of version 1
+	_, err = cache.GetMissingRegions("x", "2", 0, 100)
+	c.Assert(err, Equals, NotInCache)
+
+	local2, err := cache.GetLocalFile("x", "2", 100)
+	c.Assert(err, IsNil)
+	c.Assert(local2, Not(Equals), local1)
+	_, err = os.Stat(local1)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	missing, err := cache.GetMissingRegions("x", "2", 0, 100)
+	c.Assert(err, IsNil)
+	c.Assert(missing, DeepEquals, []Region{{0, 100}})
+
+	// a fetch of version 1 which completes late doesn't mark bytes of version 2 valid
+	cache.AddedRegions("x", "1", 50, 50)
+	missing, err = cache.GetMissingRegions("x", "2", 0, 100)
+	c.Assert(err, IsNil)
+	c.Assert(missing, DeepEquals, []Region{{0, 100}})
+	c.Assert(cache.EvictFile("x", "1"), Equals, NotInCache)
+
+	// a different size is a different version too
+	local3, err := cache.GetLocalFile("x", "2", 200)
+	c.Assert(err, IsNil)
+	c.Assert(local3, Not(Equals), local2)
+
+	// files whose deletion was interrupted are deleted when the cache is next opened
+	err = cache.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(PENDING_DELETE)).Put([]byte(local3), []byte("x"))
+	})
+	c.Assert(err, IsNil)
+	cache.Close()
+
+	cache, err = NewLocalCache(dir)
+	c.Assert(err, IsNil)
+	defer cache.Close()
+	_, err = os.Stat(local3)
+	c.Assert(os.IsNotExist(err), Equals, true)
+	cache.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(PENDING_DELETE)).ForEach(func(k, v []byte) error {
+			c.Errorf("%s is still pending deletion", string(k))
+			return nil
+		})
+	})
+}
+
 func (s *CacheSuite) TestDirOperations(c *C) {
 	cache, err := NewLocalCache(c.MkDir())
 	c.Assert(err, IsNil)
@@ -102,3 +223,194 @@ func (s *CacheSuite) TestDirOperations(c *C) {
 	c.Assert(len(dir2.Files), Equals, 1)
 	c.Assert(dir2.Files[0], DeepEquals, files[0])
 }
+
+func (s *CacheSuite) TestEviction(c *C) {
+	cache, err := NewLocalCache(c.MkDir())
+	c.Assert(err, IsNil)
+	defer cache.Close()
+
+	stats := &Stats{}
+	cache.policy = EvictionPolicy{MaxSize: 250}
+	cache.stats = stats
+
+	for _, path := range []string{"a", "b", "c", "d"} {
+		_, err := cache.GetLocalFile(path, "1", 100)
+		c.Assert(err, IsNil)
+		cache.AddedRegions(path, "1", 0, 100)
+		time.Sleep(time.Millisecond)
+	}
+
+	// "a" is the oldest but is held open.  Of the rest "c" was read least recently, then "b", so
+	// evicting down to 250 bytes removes both of them and keeps "d"
+	cache.FileOpened("a")
+	cache.GetFirstMissingRegion("c", "1", 0, 10)
+	time.Sleep(time.Millisecond)
+	cache.GetFirstMissingRegion("b", "1", 0, 10)
+	time.Sleep(time.Millisecond)
+	cache.GetFirstMissingRegion("d", "1", 0, 10)
+
+	err = cache.evict()
+	c.Assert(err, IsNil)
+
+	c.Assert(cache.EvictFile("a", ""), IsNil)
+	c.Assert(cache.EvictFile("c", ""), Equals, NotInCache)
+	c.Assert(cache.EvictFile("b", ""), Equals, NotInCache)
+	c.Assert(cache.EvictFile("d", ""), IsNil)
+	c.Assert(stats.FilesEvicted, Equals, int32(2))
+	c.Assert(stats.BytesEvicted, Equals, int64(200))
+}
+
+func (s *CacheSuite) TestEvictClosedFile(c *C) {
+	cache, err := NewLocalCache(c.MkDir())
+	c.Assert(err, IsNil)
+	defer cache.Close()
+
+	_, err = cache.GetLocalFile("a", "1", 100)
+	c.Assert(err, IsNil)
+	cache.FileOpened("a")
+	c.Assert(cache.EvictClosedFile("a", ""), Equals, FileIsOpen)
+
+	cache.FileClosed("a")
+	c.Assert(cache.EvictClosedFile("a", "2"), Equals, NotInCache)
+	c.Assert(cache.EvictClosedFile("a", "1"), IsNil)
+	c.Assert(cache.EvictClosedFile("a", ""), Equals, NotInCache)
+}
+
+func (s *CacheSuite) TestNamespaces(c *C) {
+	root := c.MkDir()
+	bucketA := BackendIdentity{Type: "s3", Bucket: "a", Prefix: "p"}
+	bucketB := BackendIdentity{Type: "s3", Bucket: "b", Prefix: "p"}
+
+	cache, err := OpenNamespacedCache(root, "", bucketA, false)
+	c.Assert(err, IsNil)
+	_, err = cache.GetLocalFile("x", "1", 100)
+	c.Assert(err, IsNil)
+	cache.Close()
+
+	// another namespace in the same directory is independent
+	other, err := OpenNamespacedCache(root, "other", bucketB, false)
+	c.Assert(err, IsNil)
+	_, err = other.GetMissingRegions("x", "1", 0, 100)
+	c.Assert(err, Equals, NotInCache)
+	other.Close()
+
+	_, err = OpenNamespacedCache(root, DefaultNamespace, bucketB, false)
+	c.Assert(err, FitsTypeOf, &IdentityMismatchError{})
+
+	cache, err = OpenNamespacedCache(root, DefaultNamespace, bucketA, false)
+	c.Assert(err, IsNil)
+	_, err = cache.GetMissingRegions("x", "1", 0, 100)
+	c.Assert(err, IsNil)
+	cache.Close()
+
+	// wiping replaces the contents and the identity
+	cache, err = OpenNamespacedCache(root, DefaultNamespace, bucketB, true)
+	c.Assert(err, IsNil)
+	_, err = cache.GetMissingRegions("x", "1", 0, 100)
+	c.Assert(err, Equals, NotInCache)
+	identity, err := cache.Identity()
+	c.Assert(err, IsNil)
+	c.Assert(*identity, Equals, bucketB)
+	cache.Close()
+
+	_, err = OpenNamespacedCache(root, "../escape", bucketA, false)
+	c.Assert(err, NotNil)
+}
+
+func (s *CacheSuite) TestLegacyCacheRemoved(c *C) {
+	root := c.MkDir()
+	legacy, err := NewLocalCache(root)
+	c.Assert(err, IsNil)
+	localPath, err := legacy.GetLocalFile("x", "1", 100)
+	c.Assert(err, IsNil)
+	legacy.Close()
+
+	cache, err := OpenNamespacedCache(root, "", BackendIdentity{Type: "s3", Bucket: "a"}, false)
+	c.Assert(err, IsNil)
+	defer cache.Close()
+
+	_, err = os.Stat(root + "/db")
+	c.Assert(os.IsNotExist(err), Equals, true)
+	_, err = os.Stat(localPath)
+	c.Assert(os.IsNotExist(err), Equals, true)
+	_, err = os.Stat(root + "/" + DefaultNamespace + "/db")
+	c.Assert(err, IsNil)
+}
+
+func (s *CacheSuite) TestFsck(c *C) {
+	dir := c.MkDir()
+	cache, err := NewLocalCache(dir)
+	c.Assert(err, IsNil)
+	defer cache.Close()
+
+	good, err := cache.GetLocalFile("good", "1", 100)
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(good, make([]byte, 100), 0600), IsNil)
+	cache.AddedRegions("good", "1", 0, 100)
+
+	// the local file was lost
+	lost, err := cache.GetLocalFile("lost", "1", 100)
+	c.Assert(err, IsNil)
+	c.Assert(os.Remove(lost), IsNil)
+
+	// regions past the end of the file, and past what was written to the local file
+	short, err := cache.GetLocalFile("short", "1", 100)
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(short, make([]byte, 30), 0600), IsNil)
+	cache.AddedRegions("short", "1", 0, 50)
+	cache.AddedRegions("short", "1", 60, 80)
+
+	// a local file nothing refers to
+	c.Assert(ioutil.WriteFile(dir+"/lorphan", make([]byte, 10), 0600), IsNil)
+
+	report, err := cache.Fsck()
+	c.Assert(err, IsNil)
+	c.Assert(*report, Equals, FsckReport{MissingLocalFiles: 1, ClippedEntries: 1, OrphanedFiles: 1, BytesFreed: 10})
+
+	missing, err := cache.GetMissingRegions("good", "1", 0, 100)
+	c.Assert(err, IsNil)
+	c.Assert(missing, DeepEquals, []Region{})
+	_, err = cache.GetMissingRegions("lost", "1", 0, 100)
+	c.Assert(err, Equals, NotInCache)
+	missing, err = cache.GetMissingRegions("short", "1", 0, 100)
+	c.Assert(err, IsNil)
+	c.Assert(missing, DeepEquals, []Region{{30, 70}})
+	_, err = os.Stat(dir + "/lorphan")
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	report, err = cache.Fsck()
+	c.Assert(err, IsNil)
+	c.Assert(report.Problems(), Equals, 0)
+}
+
+func (s *CacheSuite) TestInvalidateRecursive(c *C) {
+	cache, err := NewLocalCache(c.MkDir())
+	c.Assert(err, IsNil)
+	defer cache.Close()
+
+	for _, path := range []string{"", "a", "a/b", "a/b/c", "ab", "x"} {
+		c.Assert(cache.PutListDir(path, &DirEntries{Valid: true}), IsNil)
+	}
+	valid := func(path string) bool {
+		files, err := cache.GetListDir(path)
+		c.Assert(err, IsNil)
+		return files.Valid
+	}
+
+	count, err := cache.InvalidateRecursive("a")
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 3)
+	c.Assert(valid("a"), Equals, false)
+	c.Assert(valid("a/b/c"), Equals, false)
+	c.Assert(valid("ab"), Equals, true)
+	c.Assert(valid(""), Equals, true)
+
+	// the root's listing is found even though it is stored under "/"
+	c.Assert(cache.Invalidate(""), IsNil)
+	c.Assert(valid(""), Equals, false)
+
+	count, err = cache.InvalidateRecursive("")
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 6)
+	c.Assert(valid("x"), Equals, false)
+}
@@ -0,0 +1,347 @@
+package singleply
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// Connectors report the checksum of a whole object in FileStat.Checksum as "md5:<hex digest>" or
+// "crc32c:<base64 of the big endian checksum>", which is how S3 and GCS present them.  An empty
+// Checksum means the backend doesn't provide one, as for S3 objects uploaded in parts.
+
+var ChecksumMismatch error = errors.New("Checksum mismatch")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// BlockChecksums are the crc32c checksums of the whole blocks of a cached file, keyed by block index,
+// taken as the blocks were downloaded so that later corruption of the local file can be detected.
+// ObjectVerified is set once the complete file has been checked against the backend's checksum.
+type BlockChecksums struct {
+	BlockSize      uint64
+	Sums           map[uint64]uint32
+	ObjectVerified bool
+}
+
+// s3Checksum returns the checksum of an S3 object given its etag.  Only the etags of objects uploaded
+// in a single part are MD5 digests of their content, and not even those if the object is encrypted with
+// SSE-KMS or SSE-C.  Listings don't say how an object is encrypted, so S3Connection.SetEtagChecksums
+// turns this off for buckets which use them.
+func s3Checksum(etag string) string {
+	etag = strings.Trim(etag, "\"")
+	if len(etag) != md5.Size*2 {
+		return ""
+	}
+	if _, err := hex.DecodeString(etag); err != nil {
+		return ""
+	}
+	return "md5:" + strings.ToLower(etag)
+}
+
+func gcsChecksum(crc32c string) string {
+	if crc32c == "" {
+		return ""
+	}
+	return "crc32c:" + crc32c
+}
+
+// objectChecksum computes the checksum of the first size bytes of file with the same algorithm as
+// expected.  Returns "" if the algorithm is not supported.
+func objectChecksum(file io.ReaderAt, size uint64, expected string) (string, error) {
+	var h hash.Hash
+	algorithm := strings.SplitN(expected, ":", 2)[0]
+	switch algorithm {
+	case "md5":
+		h = md5.New()
+	case "crc32c":
+		h = crc32.New(castagnoli)
+	default:
+		return "", nil
+	}
+
+	_, err := io.Copy(h, io.NewSectionReader(file, 0, int64(size)))
+	if err != nil {
+		return "", err
+	}
+
+	if algorithm == "md5" {
+		return "md5:" + hex.EncodeToString(h.Sum(nil)), nil
+	}
+	return "crc32c:" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+func blockChecksum(file io.ReaderAt, block Region) (uint32, error) {
+	h := crc32.New(castagnoli)
+	_, err := io.Copy(h, io.NewSectionReader(file, int64(block.Offset), int64(block.Length)))
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(h.Sum(nil)), nil
+}
+
+// blockRegion returns the bytes covered by block index of a file of size bytes
+func blockRegion(index uint64, blockSize uint64, size uint64) Region {
+	start := index * blockSize
+	return Region{start, min(blockSize, size-start)}
+}
+
+// blocksWithin returns the indexes of the blocks which lie entirely within region
+func blocksWithin(region Region, blockSize uint64, size uint64) []uint64 {
+	blocks := make([]uint64, 0)
+	for index := (region.Offset + blockSize - 1) / blockSize; index*blockSize < size; index++ {
+		block := blockRegion(index, blockSize, size)
+		if block.end() > region.end() {
+			break
+		}
+		blocks = append(blocks, index)
+	}
+	return blocks
+}
+
+// blocksOverlapping returns the indexes of the blocks which contain any of region
+func blocksOverlapping(region Region, blockSize uint64) []uint64 {
+	blocks := make([]uint64, 0)
+	if region.Length == 0 {
+		return blocks
+	}
+	for index := region.Offset / blockSize; index*blockSize < region.end(); index++ {
+		blocks = append(blocks, index)
+	}
+	return blocks
+}
+
+func (fs *FS) checksumBlockSize() uint64 {
+	if fs.options.BlockSize > 0 {
+		return fs.options.BlockSize
+	}
+	return DefaultBlockSize
+}
+
+// recordChecksums takes the checksums of the whole blocks in region, which was just downloaded
+func (fs *FS) recordChecksums(path string, etag string, localPath string, size uint64, region Region) error {
+	blockSize := fs.checksumBlockSize()
+	blocks := blocksWithin(region, blockSize, size)
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	checksums := &BlockChecksums{BlockSize: blockSize, Sums: make(map[uint64]uint32)}
+	for _, index := range blocks {
+		sum, err := blockChecksum(file, blockRegion(index, blockSize, size))
+		if err != nil {
+			return err
+		}
+		checksums.Sums[index] = sum
+	}
+
+	return fs.cache.AddChecksums(path, etag, checksums)
+}
+
+// checksumMismatch evicts a copy of a file which failed verification, so it is downloaded again
+func (fs *FS) checksumMismatch(path string, etag string, what string) error {
+	fmt.Printf("Checksum mismatch in %s of %s (etag %s), evicting\n", what, path, etag)
+	fs.stats.IncChecksumMismatchCount()
+
+	err := fs.cache.EvictFile(path, etag)
+	if err == nil {
+		fs.stats.IncFilesEvicted()
+	} else if err != NotInCache {
+		return err
+	}
+	return ChecksumMismatch
+}
+
+// failChecksum records that the version of path with etag failed verification even after being
+// downloaded again.  Reads of it fail from then on, rather than downloading it over and over.
+func (fs *FS) failChecksum(path string, etag string) {
+	fs.updateLock.Lock()
+	defer fs.updateLock.Unlock()
+
+	fmt.Printf("%s (etag %s) failed verification again, not downloading it any more\n", path, etag)
+	fs.checksumFailures[path] = etag
+}
+
+func (fs *FS) checksumFailed(path string, etag string) bool {
+	fs.updateLock.Lock()
+	defer fs.updateLock.Unlock()
+
+	failed, present := fs.checksumFailures[path]
+	return present && failed == etag
+}
+
+// verify checks the blocks of the handle's copy of the file which a read of region returned, unless
+// they were already checked through this handle.  Once the whole file is in the cache, it is also
+// checked once against the checksum the backend reported.
+func (f *FileHandle) verify(file *os.File, etag string, size uint64, region Region) error {
+	checksums, err := f.fs.cache.GetChecksums(f.path, etag)
+	if err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	if f.etag != etag {
+		// the handle was reopened while this read was in progress
+		f.lock.Unlock()
+		return nil
+	}
+	expected := f.checksum
+	unchecked := make([]uint64, 0)
+	if checksums.BlockSize > 0 {
+		for _, index := range blocksOverlapping(region, checksums.BlockSize) {
+			if _, known := checksums.Sums[index]; known && !f.verified[index] {
+				unchecked = append(unchecked, index)
+			}
+		}
+	}
+	f.lock.Unlock()
+
+	for _, index := range unchecked {
+		block := blockRegion(index, checksums.BlockSize, size)
+		sum, err := blockChecksum(file, block)
+		if err != nil {
+			return err
+		}
+		if sum != checksums.Sums[index] {
+			return f.fs.checksumMismatch(f.path, etag, fmt.Sprintf("block %v", block))
+		}
+	}
+
+	f.lock.Lock()
+	for _, index := range unchecked {
+		f.verified[index] = true
+	}
+	f.lock.Unlock()
+
+	if expected == "" || checksums.ObjectVerified {
+		return nil
+	}
+	missing, err := f.fs.cache.GetMissingRegions(f.path, etag, 0, size)
+	if err != nil || len(missing) > 0 {
+		return err
+	}
+
+	actual, err := objectChecksum(file, size, expected)
+	if err != nil || actual == "" {
+		return err
+	}
+	if actual != expected {
+		fmt.Printf("%s has checksum %s but the backend reported %s\n", f.path, actual, expected)
+		f.lock.Lock()
+		refilled := f.refilled == etag
+		f.lock.Unlock()
+		if refilled {
+			// a fresh download is bad as well, so the backend keeps sending corrupt data
+			f.fs.failChecksum(f.path, etag)
+		}
+		return f.fs.checksumMismatch(f.path, etag, "the whole file")
+	}
+	return f.fs.cache.AddChecksums(f.path, etag, &BlockChecksums{BlockSize: checksums.BlockSize, ObjectVerified: true})
+}
+
+// refill gives the handle a new, empty copy of the file after the copy with etag was evicted because
+// it failed verification
+func (f *FileHandle) refill(etag string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.etag != etag {
+		return nil
+	}
+	if f.fs.checksumFailed(f.path, etag) {
+		return ChecksumMismatch
+	}
+
+	f.refilled = etag
+	return f.openCopy(&FileStat{Etag: f.etag, Size: f.size, Checksum: f.checksum})
+}
+
+// GetChecksums returns the block checksums recorded for the version of path with etag
+func (c *LocalCache) GetChecksums(path string, etag string) (*BlockChecksums, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var checksums *BlockChecksums
+	err := c.db.View(func(tx *bolt.Tx) error {
+		entryBytes := tx.Bucket([]byte(FILE_MAP)).Get([]byte(path))
+		if entryBytes == nil {
+			return NotInCache
+		}
+
+		e, err := decodeFileCacheEntry(entryBytes)
+		if err != nil {
+			return err
+		}
+		if e.Etag != etag {
+			return NotInCache
+		}
+
+		checksums = e.Checksums
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if checksums == nil {
+		checksums = &BlockChecksums{}
+	}
+	if checksums.Sums == nil {
+		checksums.Sums = make(map[uint64]uint32)
+	}
+	return checksums, nil
+}
+
+// AddChecksums merges checksums into those recorded for the version of path with etag.  Checksums
+// taken with a different block size replace the recorded ones.
+func (c *LocalCache) AddChecksums(path string, etag string, checksums *BlockChecksums) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(FILE_MAP))
+		key := []byte(path)
+		entryBytes := b.Get(key)
+		if entryBytes == nil {
+			// evicted while the checksums were being taken
+			return nil
+		}
+
+		e, err := decodeFileCacheEntry(entryBytes)
+		if err != nil {
+			return err
+		}
+		if e.Etag != etag {
+			return nil
+		}
+
+		if e.Checksums == nil || e.Checksums.BlockSize != checksums.BlockSize {
+			e.Checksums = &BlockChecksums{BlockSize: checksums.BlockSize, Sums: make(map[uint64]uint32)}
+		}
+		for index, sum := range checksums.Sums {
+			e.Checksums.Sums[index] = sum
+		}
+		e.Checksums.ObjectVerified = e.Checksums.ObjectVerified || checksums.ObjectVerified
+
+		encoded, err := encodeFileCacheEntry(e)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, encoded)
+	})
+}
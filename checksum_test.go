@@ -0,0 +1,161 @@
+package singleply
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"os"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	. "gopkg.in/check.v1"
+)
+
+type ChecksumSuite struct{}
+
+var _ = Suite(&ChecksumSuite{})
+
+// corruptingConn serves "dir/f" with an MD5 checksum of its true contents, but flips a byte in the
+// next corrupt fetches, like a misbehaving proxy
+type corruptingConn struct {
+	*recordingConn
+	corrupt int
+}
+
+func newCorruptingConn(size uint64) *corruptingConn {
+	h := md5.New()
+	for offset := uint64(0); offset < size; offset++ {
+		h.Write([]byte{contentAt(offset)})
+	}
+	checksum := "md5:" + hex.EncodeToString(h.Sum(nil))
+	return &corruptingConn{recordingConn: newRecordingConn(&FileStat{Name: "f", Size: size, Etag: "1", Checksum: checksum})}
+}
+
+func (c *corruptingConn) ListDir(ctx context.Context, path string, status StatusCallback) (*DirEntries, error) {
+	if path == "" {
+		return &DirEntries{Files: []*FileStat{{Name: "dir", IsDir: true}}}, nil
+	}
+	return c.recordingConn.ListDir(ctx, path, status)
+}
+
+func (c *corruptingConn) PrepareForRead(ctx context.Context, path string, etag string, localPath string, offset uint64, length uint64, status StatusCallback) (*Region, error) {
+	prepared, err := c.recordingConn.PrepareForRead(ctx, path, etag, localPath, offset, length, status)
+	if err != nil {
+		return prepared, err
+	}
+
+	c.lock.Lock()
+	corrupt := c.corrupt > 0
+	if corrupt {
+		c.corrupt--
+	}
+	c.lock.Unlock()
+	if corrupt {
+		flipByte(localPath, int64(offset))
+	}
+	return prepared, nil
+}
+
+func flipByte(localPath string, offset int64) {
+	f, err := os.OpenFile(localPath, os.O_RDWR, 0)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	b := make([]byte, 1)
+	f.ReadAt(b, offset)
+	b[0] ^= 0xff
+	f.WriteAt(b, offset)
+}
+
+func expectedContent(offset uint64, length int) []byte {
+	content := make([]byte, length)
+	for i := range content {
+		content[i] = contentAt(offset + uint64(i))
+	}
+	return content
+}
+
+func (s *ChecksumSuite) TestBackendChecksums(c *C) {
+	c.Assert(s3Checksum("\"9E107D9D372BB6826BD81D3542A419D6\""), Equals, "md5:9e107d9d372bb6826bd81d3542a419d6")
+	// objects uploaded in parts have etags which are not a digest of the content
+	c.Assert(s3Checksum("\"9e107d9d372bb6826bd81d3542a419d6-3\""), Equals, "")
+
+	sum, err := objectChecksum(bytes.NewReader([]byte("123456789")), 9, gcsChecksum("4waSgw=="))
+	c.Assert(err, IsNil)
+	c.Assert(sum, Equals, "crc32c:4waSgw==")
+
+	sum, err = objectChecksum(bytes.NewReader([]byte("123456789")), 9, "sha1:whatever")
+	c.Assert(err, IsNil)
+	c.Assert(sum, Equals, "")
+}
+
+func (s *ChecksumSuite) TestBlocks(c *C) {
+	c.Assert(blocksWithin(Region{0, 250}, 100, 250), DeepEquals, []uint64{0, 1, 2})
+	c.Assert(blocksWithin(Region{50, 150}, 100, 1000), DeepEquals, []uint64{1})
+	c.Assert(blocksWithin(Region{50, 100}, 100, 1000), DeepEquals, []uint64{})
+	c.Assert(blocksOverlapping(Region{50, 100}, 100), DeepEquals, []uint64{0, 1})
+}
+
+func (s *ChecksumSuite) TestCorruptDownloadIsRetried(c *C) {
+	conn := newCorruptingConn(1000)
+	conn.corrupt = 1
+	fs, cache := newTestFS(c, conn, &FSOptions{BlockSize: 100, VerifyChecksums: true})
+	defer cache.Close()
+
+	handle := openTestFile(c, fs, "dir/f")
+	data, err := readAt(handle, 0, 1000)
+	c.Assert(err, IsNil)
+	c.Assert(data, DeepEquals, expectedContent(0, 1000))
+	c.Assert(fs.stats.ChecksumMismatchCount, Equals, int32(1))
+	c.Assert(conn.takeRequests(), DeepEquals, []Region{{0, 1000}, {0, 1000}})
+
+	checksums, err := cache.GetChecksums("dir/f", "1")
+	c.Assert(err, IsNil)
+	c.Assert(checksums.ObjectVerified, Equals, true)
+	c.Assert(checksums.Sums, HasLen, 10)
+
+	// a persistently corrupt backend fails the read rather than returning bad data, and later reads
+	// fail without downloading the file over and over
+	conn.corrupt = 2
+	c.Assert(cache.EvictFile("dir/f", ""), IsNil)
+	handle = openTestFile(c, fs, "dir/f")
+	_, err = readAt(handle, 0, 1000)
+	c.Assert(err, Equals, fuse.EIO)
+	c.Assert(fs.stats.ChecksumMismatchCount, Equals, int32(3))
+	c.Assert(conn.takeRequests(), DeepEquals, []Region{{0, 1000}, {0, 1000}})
+
+	_, err = readAt(handle, 0, 1000)
+	c.Assert(err, Equals, fuse.EIO)
+	c.Assert(conn.takeRequests(), HasLen, 0)
+	_, err = cache.GetChecksums("dir/f", "1")
+	c.Assert(err, Equals, NotInCache)
+}
+
+func (s *ChecksumSuite) TestLocalCorruptionIsDetected(c *C) {
+	conn := newCorruptingConn(1000)
+	fs, cache := newTestFS(c, conn, &FSOptions{BlockSize: 100, VerifyChecksums: true})
+	defer cache.Close()
+
+	handle := openTestFile(c, fs, "dir/f")
+	_, err := readAt(handle, 0, 500)
+	c.Assert(err, IsNil)
+	conn.takeRequests()
+
+	// bitrot in the local copy after it was downloaded
+	flipByte(handle.file.Name(), 250)
+
+	handle = openTestFile(c, fs, "dir/f")
+	data, err := readAt(handle, 200, 100)
+	c.Assert(err, IsNil)
+	c.Assert(data, DeepEquals, expectedContent(200, 100))
+	c.Assert(fs.stats.ChecksumMismatchCount, Equals, int32(1))
+	c.Assert(conn.takeRequests(), DeepEquals, []Region{{200, 100}})
+
+	// blocks which were not read are not checked, and are fetched again as the copy was evicted
+	data, err = readAt(handle, 0, 100)
+	c.Assert(err, IsNil)
+	c.Assert(data, DeepEquals, expectedContent(0, 100))
+	c.Assert(conn.takeRequests(), DeepEquals, []Region{{0, 100}})
+}
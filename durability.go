@@ -0,0 +1,266 @@
+package singleply
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Durability controls how regions are committed to the cache, trading speed against what survives a
+// crash or power loss.  The local file is always fsynced before a region of it is recorded, except
+// with DurabilityNone, so a region is never recorded ahead of its data.
+type Durability int
+
+const (
+	// DurabilityRegion fsyncs the local file and records each region as soon as it is fetched
+	DurabilityRegion Durability = iota
+
+	// DurabilityBatched keeps fetched regions in memory, and periodically fsyncs the files they belong
+	// to and records them all in one transaction.  A crash loses the regions fetched since the last
+	// batch, which are fetched again.
+	DurabilityBatched
+
+	// DurabilityNone records each region without fsyncing.  After a power loss, regions may read back
+	// as zeros.
+	DurabilityNone
+)
+
+const DefaultBatchInterval = time.Second
+
+func (d Durability) String() string {
+	switch d {
+	case DurabilityRegion:
+		return "region"
+	case DurabilityBatched:
+		return "batched"
+	case DurabilityNone:
+		return "none"
+	}
+	return fmt.Sprintf("Durability(%d)", int(d))
+}
+
+func ParseDurability(s string) (Durability, error) {
+	switch strings.ToLower(s) {
+	case "region":
+		return DurabilityRegion, nil
+	case "batched":
+		return DurabilityBatched, nil
+	case "none":
+		return DurabilityNone, nil
+	}
+	return DurabilityRegion, fmt.Errorf("Unknown durability \"%s\", expected region, batched or none", s)
+}
+
+// unsyncedRegions are regions of one version of a file which have been fetched but not yet recorded
+type unsyncedRegions struct {
+	etag    string
+	regions RegionSet
+}
+
+func syncFile(localPath string) error {
+	f, err := os.OpenFile(localPath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// SetDurability changes how regions are committed.  With DurabilityBatched, regions are committed
+// every interval, or DefaultBatchInterval if interval is zero.
+func (c *LocalCache) SetDurability(durability Durability, interval time.Duration) {
+	if interval == 0 {
+		interval = DefaultBatchInterval
+	}
+
+	c.lock.Lock()
+	previous := c.durability
+	c.durability = durability
+
+	// each run of the batcher has its own channels, so stopping one never affects the next
+	var stopped, stoppedDone chan bool
+	if durability != DurabilityBatched && c.batcherStop != nil {
+		stopped, stoppedDone = c.batcherStop, c.batcherDone
+		c.batcherStop, c.batcherDone = nil, nil
+	}
+	var stop, done chan bool
+	if durability == DurabilityBatched && c.batcherStop == nil {
+		stop, done = make(chan bool), make(chan bool)
+		c.batcherStop, c.batcherDone = stop, done
+	}
+	c.lock.Unlock()
+
+	if stopped != nil {
+		close(stopped)
+		<-stoppedDone
+	}
+	if previous == DurabilityBatched && durability != DurabilityBatched {
+		c.flushUnsynced()
+	}
+	if stop != nil {
+		go c.runBatcher(interval, stop, done)
+	}
+}
+
+// runBatcher commits the unsynced regions every interval until the cache is closed or stop is closed,
+// and closes done when it returns
+func (c *LocalCache) runBatcher(interval time.Duration, stop chan bool, done chan bool) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		err := c.flushUnsynced()
+		if err != nil {
+			fmt.Printf("committing regions failed: %s\n", err.Error())
+		}
+	}
+}
+
+// localPathOf returns the local file of the version of path with etag, or NotInCache if that version
+// isn't cached.  Must be called with lock held.
+func (c *LocalCache) localPathOf(path string, etag string) (string, error) {
+	localPath := ""
+	err := c.db.View(func(tx *bolt.Tx) error {
+		entryBytes := tx.Bucket([]byte(FILE_MAP)).Get([]byte(path))
+		if entryBytes == nil {
+			return NotInCache
+		}
+
+		e, err := decodeFileCacheEntry(entryBytes)
+		if err != nil {
+			return err
+		}
+		if e.Etag != etag {
+			return NotInCache
+		}
+		localPath = e.LocalPath
+		return nil
+	})
+	return localPath, err
+}
+
+// recordRegions marks regions of the version of path with etag as valid.  localPath is the local file
+// the regions were written to, which has already been fsynced if that was needed.  Nothing is recorded
+// if path was evicted or replaced by another version since.  Must be called with lock held.
+func (c *LocalCache) recordRegions(tx *bolt.Tx, path string, etag string, localPath string, regions []Region) error {
+	b := tx.Bucket([]byte(FILE_MAP))
+	key := []byte(path)
+	entryBytes := b.Get(key)
+	if entryBytes == nil {
+		// evicted while the region was being fetched
+		return nil
+	}
+
+	e, err := decodeFileCacheEntry(entryBytes)
+	if err != nil {
+		return err
+	}
+	if e.Etag != etag || e.LocalPath != localPath {
+		// replaced by another version while the region was being fetched
+		return nil
+	}
+
+	for _, region := range regions {
+		e.Valid.add(region)
+	}
+	e.LastAccess = time.Now().UnixNano()
+	delete(c.accessed, path)
+
+	encoded, err := encodeFileCacheEntry(e)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, encoded)
+}
+
+// flushUnsynced fsyncs the files with unsynced regions and records the regions.  Files which fail to
+// sync lose their unsynced regions, which will be fetched again.  The files are synced without holding
+// lock, and regions added meanwhile wait for the next batch.
+func (c *LocalCache) flushUnsynced() error {
+	c.flushLock.Lock()
+	defer c.flushLock.Unlock()
+
+	c.lock.Lock()
+	if len(c.unsynced) == 0 {
+		c.lock.Unlock()
+		return nil
+	}
+	flushing := c.unsynced
+	c.unsynced = make(map[string]*unsyncedRegions)
+	c.flushing = flushing
+	localPaths := make(map[string]string)
+	for path, pending := range flushing {
+		localPath, err := c.localPathOf(path, pending.etag)
+		if err == nil {
+			localPaths[path] = localPath
+		} else if err != NotInCache {
+			fmt.Printf("Could not commit regions of %s: %s\n", path, err.Error())
+		}
+	}
+	c.lock.Unlock()
+
+	for path, localPath := range localPaths {
+		err := c.sync(localPath)
+		if err != nil {
+			fmt.Printf("Could not commit regions of %s: %s\n", path, err.Error())
+			delete(localPaths, path)
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		for path, localPath := range localPaths {
+			pending := flushing[path]
+			if pending == nil {
+				// evicted while it was being synced
+				continue
+			}
+			err := c.recordRegions(tx, path, pending.etag, localPath, pending.regions.Regions)
+			if err != nil {
+				fmt.Printf("Could not commit regions of %s: %s\n", path, err.Error())
+			}
+		}
+		return nil
+	})
+	c.flushing = nil
+	c.requestEviction()
+	return err
+}
+
+// forgetUnsynced drops the unsynced regions of path, when its entry is deleted.  Must be called with
+// lock held.
+func (c *LocalCache) forgetUnsynced(path string) {
+	delete(c.unsynced, path)
+	delete(c.flushing, path)
+}
+
+// withUnsynced removes the regions which are fetched but not yet recorded from missing.  Must be
+// called with lock held.
+func (c *LocalCache) withUnsynced(path string, etag string, missing []Region) []Region {
+	for _, unsynced := range []map[string]*unsyncedRegions{c.unsynced, c.flushing} {
+		pending := unsynced[path]
+		if pending == nil || pending.etag != etag {
+			continue
+		}
+
+		result := make([]Region, 0, len(missing))
+		for _, region := range missing {
+			result = append(result, pending.regions.missing(region)...)
+		}
+		missing = result
+	}
+	return missing
+}
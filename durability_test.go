@@ -0,0 +1,222 @@
+package singleply
+
+import (
+	"errors"
+	"io/ioutil"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type DurabilitySuite struct{}
+
+var _ = Suite(&DurabilitySuite{})
+
+// crash stops the cache without committing anything held in memory, as if the process died
+func crash(cache *LocalCache) {
+	close(cache.stop)
+	if cache.batcherDone != nil {
+		<-cache.batcherDone
+	}
+	cache.db.Close()
+}
+
+// openWithSyncs opens a cache which counts how often each local file is fsynced, and fails to fsync
+// when fail is set
+func openWithSyncs(c *C, dir string, fail *bool) (*LocalCache, map[string]int) {
+	cache, err := NewLocalCache(dir)
+	c.Assert(err, IsNil)
+
+	syncs := make(map[string]int)
+	cache.sync = func(localPath string) error {
+		if fail != nil && *fail {
+			return errors.New("sync failed")
+		}
+		syncs[localPath]++
+		return syncFile(localPath)
+	}
+	return cache, syncs
+}
+
+func writeLocal(c *C, cache *LocalCache, path string) string {
+	localPath, err := cache.GetLocalFile(path, "1", 100)
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(localPath, make([]byte, 100), 0600), IsNil)
+	return localPath
+}
+
+func (s *DurabilitySuite) TestParseDurability(c *C) {
+	for _, d := range []Durability{DurabilityRegion, DurabilityBatched, DurabilityNone} {
+		parsed, err := ParseDurability(d.String())
+		c.Assert(err, IsNil)
+		c.Assert(parsed, Equals, d)
+	}
+	_, err := ParseDurability("sometimes")
+	c.Assert(err, NotNil)
+}
+
+func (s *DurabilitySuite) TestRegionDurability(c *C) {
+	dir := c.MkDir()
+	fail := false
+	cache, syncs := openWithSyncs(c, dir, &fail)
+
+	localPath := writeLocal(c, cache, "f")
+	c.Assert(cache.AddedRegions("f", "1", 0, 50), IsNil)
+	c.Assert(syncs[localPath], Equals, 1)
+
+	// the data was written but could not be made durable, so the region must not be recorded
+	fail = true
+	c.Assert(cache.AddedRegions("f", "1", 50, 50), NotNil)
+
+	crash(cache)
+	cache, _ = openWithSyncs(c, dir, nil)
+	defer cache.Close()
+
+	missing, err := cache.GetMissingRegions("f", "1", 0, 100)
+	c.Assert(err, IsNil)
+	c.Assert(missing, DeepEquals, []Region{{50, 50}})
+}
+
+func (s *DurabilitySuite) TestBatchedLosesUncommittedRegions(c *C) {
+	dir := c.MkDir()
+	cache, syncs := openWithSyncs(c, dir, nil)
+	cache.SetDurability(DurabilityBatched, time.Hour)
+
+	writeLocal(c, cache, "f")
+	c.Assert(cache.AddedRegions("f", "1", 0, 50), IsNil)
+
+	// uncommitted regions are still served while the cache is running
+	missing, err := cache.GetMissingRegions("f", "1", 0, 100)
+	c.Assert(err, IsNil)
+	c.Assert(missing, DeepEquals, []Region{{50, 50}})
+	c.Assert(syncs, HasLen, 0)
+
+	// a crash between writing the data and committing the batch loses the region, but nothing
+	// is recorded that was not synced
+	crash(cache)
+	cache, _ = openWithSyncs(c, dir, nil)
+	defer cache.Close()
+
+	missing, err = cache.GetMissingRegions("f", "1", 0, 100)
+	c.Assert(err, IsNil)
+	c.Assert(missing, DeepEquals, []Region{{0, 100}})
+}
+
+func (s *DurabilitySuite) TestBatchedCommit(c *C) {
+	dir := c.MkDir()
+	cache, syncs := openWithSyncs(c, dir, nil)
+	cache.SetDurability(DurabilityBatched, time.Hour)
+
+	f := writeLocal(c, cache, "f")
+	g := writeLocal(c, cache, "g")
+	c.Assert(cache.AddedRegions("f", "1", 0, 10), IsNil)
+	c.Assert(cache.AddedRegions("f", "1", 20, 10), IsNil)
+	c.Assert(cache.AddedRegions("g", "1", 0, 100), IsNil)
+
+	// an evicted file's pending regions are dropped rather than committed
+	c.Assert(cache.EvictFile("g", ""), IsNil)
+
+	c.Assert(cache.flushUnsynced(), IsNil)
+	c.Assert(syncs[f], Equals, 1)
+	c.Assert(syncs[g], Equals, 0)
+
+	crash(cache)
+	cache, _ = openWithSyncs(c, dir, nil)
+	defer cache.Close()
+
+	missing, err := cache.GetMissingRegions("f", "1", 0, 100)
+	c.Assert(err, IsNil)
+	c.Assert(missing, DeepEquals, []Region{{10, 10}, {30, 70}})
+	_, err = cache.GetMissingRegions("g", "1", 0, 100)
+	c.Assert(err, Equals, NotInCache)
+}
+
+func (s *DurabilitySuite) TestCloseCommitsBatch(c *C) {
+	dir := c.MkDir()
+	cache, _ := openWithSyncs(c, dir, nil)
+	cache.SetDurability(DurabilityBatched, time.Hour)
+
+	writeLocal(c, cache, "f")
+	c.Assert(cache.AddedRegions("f", "1", 0, 100), IsNil)
+	c.Assert(cache.Close(), IsNil)
+
+	cache, _ = openWithSyncs(c, dir, nil)
+	defer cache.Close()
+	missing, err := cache.GetMissingRegions("f", "1", 0, 100)
+	c.Assert(err, IsNil)
+	c.Assert(missing, DeepEquals, []Region{})
+}
+
+func (s *DurabilitySuite) TestNoneDoesNotSync(c *C) {
+	dir := c.MkDir()
+	cache, syncs := openWithSyncs(c, dir, nil)
+	cache.SetDurability(DurabilityNone, 0)
+
+	writeLocal(c, cache, "f")
+	c.Assert(cache.AddedRegions("f", "1", 0, 100), IsNil)
+	c.Assert(syncs, HasLen, 0)
+
+	crash(cache)
+	cache, _ = openWithSyncs(c, dir, nil)
+	defer cache.Close()
+	missing, err := cache.GetMissingRegions("f", "1", 0, 100)
+	c.Assert(err, IsNil)
+	c.Assert(missing, DeepEquals, []Region{})
+}
+
+func (s *DurabilitySuite) TestSyncDoesNotBlockCache(c *C) {
+	for _, durability := range []Durability{DurabilityRegion, DurabilityBatched} {
+		cache, err := NewLocalCache(c.MkDir())
+		c.Assert(err, IsNil)
+		cache.SetDurability(durability, time.Hour)
+
+		// other callers of the cache carry on while a file is being fsynced
+		blocked := false
+		cache.sync = func(localPath string) error {
+			done := make(chan bool)
+			go func() {
+				cache.GetMissingRegions("f", "1", 0, 100)
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				blocked = true
+			}
+			return syncFile(localPath)
+		}
+
+		writeLocal(c, cache, "f")
+		c.Assert(cache.AddedRegions("f", "1", 0, 100), IsNil)
+		c.Assert(cache.flushUnsynced(), IsNil)
+		c.Assert(blocked, Equals, false)
+
+		missing, err := cache.GetMissingRegions("f", "1", 0, 100)
+		c.Assert(err, IsNil)
+		c.Assert(missing, DeepEquals, []Region{})
+		c.Assert(cache.Close(), IsNil)
+	}
+}
+
+func (s *DurabilitySuite) TestSwitchingBatchedStopsBatcher(c *C) {
+	cache, err := NewLocalCache(c.MkDir())
+	c.Assert(err, IsNil)
+
+	cache.SetDurability(DurabilityBatched, time.Hour)
+	first := cache.batcherDone
+	cache.SetDurability(DurabilityBatched, time.Hour)
+	c.Assert(cache.batcherDone, Equals, first)
+
+	cache.SetDurability(DurabilityRegion, 0)
+	select {
+	case <-first:
+	case <-time.After(time.Second):
+		c.Fatal("batcher still running after leaving batched durability")
+	}
+	c.Assert(cache.batcherDone, IsNil)
+
+	// starting again runs a new batcher, which closing the cache stops
+	cache.SetDurability(DurabilityBatched, time.Hour)
+	c.Assert(cache.batcherDone, NotNil)
+	c.Assert(cache.Close(), IsNil)
+}
@@ -0,0 +1,188 @@
+package singleply
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"google.golang.org/api/googleapi"
+)
+
+// BackendErrorKind classifies the failures of a storage backend which need to be reported to the
+// kernel as something more specific than EIO
+type BackendErrorKind int
+
+const (
+	BackendNotFound BackendErrorKind = iota
+	BackendAccessDenied
+	BackendThrottled
+	BackendTimeout
+	BackendPreconditionFailed
+)
+
+func (k BackendErrorKind) String() string {
+	switch k {
+	case BackendNotFound:
+		return "not found"
+	case BackendAccessDenied:
+		return "access denied"
+	case BackendThrottled:
+		return "throttled"
+	case BackendTimeout:
+		return "timed out"
+	case BackendPreconditionFailed:
+		return "precondition failed"
+	}
+	return fmt.Sprintf("BackendErrorKind(%d)", int(k))
+}
+
+// BackendError is a failure reported by a Connector.  It implements fuse.ErrorNumber, so returning it
+// from a FUSE request reports the matching errno.  Err is the error from the backend, if any.
+type BackendError struct {
+	Kind BackendErrorKind
+	Path string
+	Err  error
+}
+
+func (e *BackendError) Error() string {
+	msg := e.Kind.String()
+	if e.Err != nil {
+		msg = e.Err.Error()
+	}
+	if e.Path != "" {
+		return fmt.Sprintf("%s: %s", e.Path, msg)
+	}
+	return msg
+}
+
+func (e *BackendError) Errno() fuse.Errno {
+	switch e.Kind {
+	case BackendNotFound:
+		return fuse.ENOENT
+	case BackendAccessDenied:
+		return fuse.Errno(syscall.EACCES)
+	case BackendThrottled:
+		return fuse.Errno(syscall.EAGAIN)
+	case BackendTimeout:
+		return fuse.Errno(syscall.ETIMEDOUT)
+	case BackendPreconditionFailed:
+		return fuse.ESTALE
+	}
+	return fuse.EIO
+}
+
+var UpdateDetected error = &BackendError{Kind: BackendPreconditionFailed, Err: errors.New("Detected change to file")}
+
+// statusKind returns the kind of failure an HTTP status code means, if it is one which gets a kind
+func statusKind(code int) (BackendErrorKind, bool) {
+	switch code {
+	case http.StatusNotFound:
+		return BackendNotFound, true
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return BackendAccessDenied, true
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return BackendThrottled, true
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return BackendTimeout, true
+	case http.StatusPreconditionFailed:
+		return BackendPreconditionFailed, true
+	}
+	return 0, false
+}
+
+// s3CodeKinds maps the error codes S3 reports which get a kind
+var s3CodeKinds = map[string]BackendErrorKind{
+	"NoSuchKey":             BackendNotFound,
+	"NoSuchBucket":          BackendNotFound,
+	"NotFound":              BackendNotFound,
+	"AccessDenied":          BackendAccessDenied,
+	"Forbidden":             BackendAccessDenied,
+	"InvalidAccessKeyId":    BackendAccessDenied,
+	"SignatureDoesNotMatch": BackendAccessDenied,
+	"SlowDown":              BackendThrottled,
+	"Throttling":            BackendThrottled,
+	"RequestLimitExceeded":  BackendThrottled,
+	"RequestTimeout":        BackendTimeout,
+	"PreconditionFailed":    BackendPreconditionFailed,
+}
+
+// isTimeout reports whether err, once unwrapped, is a network timeout
+func isTimeout(err error) bool {
+	for err != nil {
+		if isCancellation(err) {
+			// the caller gave up, which isn't the backend's fault
+			return false
+		}
+		switch e := err.(type) {
+		case awserr.Error:
+			err = e.OrigErr()
+		case *url.Error:
+			err = e.Err
+		case net.Error:
+			return e.Timeout()
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// newBackendError wraps err as a BackendError of kind, except that failed preconditions are always
+// reported as UpdateDetected
+func newBackendError(kind BackendErrorKind, path string, err error) error {
+	if kind == BackendPreconditionFailed {
+		return UpdateDetected
+	}
+	return &BackendError{Kind: kind, Path: path, Err: err}
+}
+
+// classifyS3Error converts an error from the S3 API into a BackendError if it is one of the kinds
+// which get their own errno.  Other errors are returned unchanged.
+func classifyS3Error(path string, err error) error {
+	if aerr, ok := err.(awserr.Error); ok {
+		if kind, ok := s3CodeKinds[aerr.Code()]; ok {
+			return newBackendError(kind, path, err)
+		}
+	}
+	if reqFailure, ok := err.(awserr.RequestFailure); ok {
+		if kind, ok := statusKind(reqFailure.StatusCode()); ok {
+			return newBackendError(kind, path, err)
+		}
+	}
+	if isTimeout(err) {
+		return newBackendError(BackendTimeout, path, err)
+	}
+	return err
+}
+
+// classifyGCSError converts an error from the GCS API into a BackendError if it is one of the kinds
+// which get their own errno.  Other errors are returned unchanged.
+func classifyGCSError(path string, err error) error {
+	if gerr, ok := err.(*googleapi.Error); ok {
+		if kind, ok := statusKind(gerr.Code); ok {
+			return newBackendError(kind, path, err)
+		}
+	}
+	if isTimeout(err) {
+		return newBackendError(BackendTimeout, path, err)
+	}
+	return err
+}
+
+// classifyLocalError converts an error from the local filesystem into a BackendError if it is one of
+// the kinds which get their own errno.  Other errors are returned unchanged.
+func classifyLocalError(path string, err error) error {
+	if os.IsNotExist(err) {
+		return newBackendError(BackendNotFound, path, err)
+	}
+	if os.IsPermission(err) {
+		return newBackendError(BackendAccessDenied, path, err)
+	}
+	return err
+}
@@ -0,0 +1,73 @@
+package singleply
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+	. "gopkg.in/check.v1"
+)
+
+type ErrorsSuite struct{}
+
+var _ = Suite(&ErrorsSuite{})
+
+// errnoOf returns the errno the kernel would see for err
+func errnoOf(err error) fuse.Errno {
+	if numbered, ok := fuseError(err).(fuse.ErrorNumber); ok {
+		return numbered.Errno()
+	}
+	return fuse.DefaultErrno
+}
+
+func (s *ErrorsSuite) TestS3Errors(c *C) {
+	s3Error := func(code string, status int) error {
+		return awserr.NewRequestFailure(awserr.New(code, "message", nil), status, "id")
+	}
+
+	c.Assert(errnoOf(classifyS3Error("f", s3Error("NoSuchKey", 404))), Equals, fuse.ENOENT)
+	c.Assert(errnoOf(classifyS3Error("f", s3Error("AccessDenied", 403))), Equals, fuse.Errno(syscall.EACCES))
+	c.Assert(errnoOf(classifyS3Error("f", s3Error("SlowDown", 503))), Equals, fuse.Errno(syscall.EAGAIN))
+	c.Assert(errnoOf(classifyS3Error("f", s3Error("RequestTimeout", 400))), Equals, fuse.Errno(syscall.ETIMEDOUT))
+	c.Assert(classifyS3Error("f", s3Error("PreconditionFailed", 412)), Equals, UpdateDetected)
+	c.Assert(errnoOf(UpdateDetected), Equals, fuse.ESTALE)
+
+	timeout := awserr.New("RequestError", "send request failed", &net.OpError{Op: "read", Err: timeoutError{}})
+	c.Assert(errnoOf(classifyS3Error("f", timeout)), Equals, fuse.Errno(syscall.ETIMEDOUT))
+
+	// anything else is passed through untouched
+	other := s3Error("InternalError", 500)
+	c.Assert(classifyS3Error("f", other), Equals, other)
+	c.Assert(errnoOf(other), Equals, fuse.EIO)
+}
+
+func (s *ErrorsSuite) TestGCSErrors(c *C) {
+	c.Assert(errnoOf(classifyGCSError("f", &googleapi.Error{Code: 404})), Equals, fuse.ENOENT)
+	c.Assert(errnoOf(classifyGCSError("f", &googleapi.Error{Code: 401})), Equals, fuse.Errno(syscall.EACCES))
+	c.Assert(errnoOf(classifyGCSError("f", &googleapi.Error{Code: 429})), Equals, fuse.Errno(syscall.EAGAIN))
+	c.Assert(classifyGCSError("f", &googleapi.Error{Code: 412}), Equals, UpdateDetected)
+
+	err := classifyGCSError("f", &googleapi.Error{Code: 403, Message: "no"})
+	c.Assert(err.(*BackendError).Kind, Equals, BackendAccessDenied)
+	c.Assert(err.(*BackendError).Path, Equals, "f")
+	c.Assert(errnoOf(err), Equals, fuse.Errno(syscall.EACCES))
+	c.Assert(isRetryable(err), Equals, false)
+	c.Assert(isRetryable(classifyGCSError("f", &googleapi.Error{Code: 429})), Equals, true)
+}
+
+func (s *ErrorsSuite) TestCancellationIsNotATimeout(c *C) {
+	c.Assert(classifyS3Error("f", context.DeadlineExceeded), Equals, context.DeadlineExceeded)
+	c.Assert(isNetworkError(context.DeadlineExceeded), Equals, false)
+	c.Assert(errnoOf(context.Canceled), Equals, fuse.EINTR)
+	c.Assert(errnoOf(errors.New("other")), Equals, fuse.EIO)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -0,0 +1,417 @@
+package singleply
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/net/context"
+)
+
+// EvictionPolicy bounds how much disk the cache may use.  A zero MaxSize means the cache may grow
+// without limit and a zero MinFreeSpace disables the free disk space check.
+type EvictionPolicy struct {
+	MaxSize      uint64
+	MinFreeSpace uint64
+	Interval     time.Duration
+}
+
+const DefaultEvictionInterval = 30 * time.Second
+
+func (p *EvictionPolicy) enabled() bool {
+	return p.MaxSize > 0 || p.MinFreeSpace > 0
+}
+
+type evictionCandidate struct {
+	path       string
+	localPath  string
+	size       uint64
+	lastAccess int64
+}
+
+// StartEviction starts a background goroutine which evicts the least recently read files whenever
+// the cache exceeds the limits in policy.  Files which are currently open or pinned are never evicted.
+func (c *LocalCache) StartEviction(policy EvictionPolicy, stats *Stats) {
+	if !policy.enabled() {
+		return
+	}
+	if policy.Interval == 0 {
+		policy.Interval = DefaultEvictionInterval
+	}
+
+	c.lock.Lock()
+	c.policy = policy
+	c.stats = stats
+	c.lock.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(policy.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+			case <-c.evictTrigger:
+			}
+
+			err := c.evict()
+			if err != nil {
+				fmt.Printf("eviction failed: %s\n", err.Error())
+			}
+		}
+	}()
+}
+
+// requestEviction wakes up the eviction goroutine without waiting for it.  Must be called with lock held.
+func (c *LocalCache) requestEviction() {
+	if !c.policy.enabled() {
+		return
+	}
+	select {
+	case c.evictTrigger <- true:
+	default:
+	}
+}
+
+func freeSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
+
+// flushAccessTimes writes the access times recorded since the last flush into FILE_MAP.  Must be
+// called with lock held.
+func (c *LocalCache) flushAccessTimes(tx *bolt.Tx) error {
+	b := tx.Bucket([]byte(FILE_MAP))
+	for path, lastAccess := range c.accessed {
+		key := []byte(path)
+		entryBytes := b.Get(key)
+		if entryBytes == nil {
+			continue
+		}
+
+		e, err := decodeFileCacheEntry(entryBytes)
+		if err != nil {
+			return err
+		}
+
+		if lastAccess > e.LastAccess {
+			e.LastAccess = lastAccess
+		}
+
+		encoded, err := encodeFileCacheEntry(e)
+		if err != nil {
+			return err
+		}
+		b.Put(key, encoded)
+	}
+	c.accessed = make(map[string]int64)
+	return nil
+}
+
+func (c *LocalCache) evict() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var total uint64
+	candidates := make([]*evictionCandidate, 0, 100)
+
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		err := c.flushAccessTimes(tx)
+		if err != nil {
+			return err
+		}
+
+		pins := tx.Bucket([]byte(PINS))
+		b := tx.Bucket([]byte(FILE_MAP))
+		return b.ForEach(func(k, v []byte) error {
+			e, err := decodeFileCacheEntry(v)
+			if err != nil {
+				return err
+			}
+
+			size := e.Valid.total()
+			total += size
+			if c.open[string(k)] == 0 && !isPinned(pins, string(k)) {
+				candidates = append(candidates, &evictionCandidate{path: string(k), localPath: e.LocalPath, size: size, lastAccess: e.LastAccess})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	var free uint64
+	if c.policy.MinFreeSpace > 0 {
+		free, err = freeSpace(c.rootDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	overBudget := func() bool {
+		return (c.policy.MaxSize > 0 && total > c.policy.MaxSize) || (c.policy.MinFreeSpace > 0 && free < c.policy.MinFreeSpace)
+	}
+
+	if !overBudget() {
+		return nil
+	}
+
+	sort.Sort(byLastAccess(candidates))
+
+	victims := make([]*evictionCandidate, 0, len(candidates))
+	for _, candidate := range candidates {
+		if !overBudget() {
+			break
+		}
+		victims = append(victims, candidate)
+		total -= candidate.size
+		free += candidate.size
+	}
+
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(FILE_MAP))
+		for _, victim := range victims {
+			err := b.Delete([]byte(victim.path))
+			if err != nil {
+				return err
+			}
+			c.forgetUnsynced(victim.path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, victim := range victims {
+		fmt.Printf("Evicting %s (%d bytes, local file %s)\n", victim.path, victim.size, victim.localPath)
+		err = os.Remove(victim.localPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if c.stats != nil {
+			c.stats.IncFilesEvicted()
+			c.stats.IncBytesEvicted(int64(victim.size))
+		}
+	}
+
+	return nil
+}
+
+type byLastAccess []*evictionCandidate
+
+func (a byLastAccess) Len() int           { return len(a) }
+func (a byLastAccess) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byLastAccess) Less(i, j int) bool { return a[i].lastAccess < a[j].lastAccess }
+
+// CachedFile describes the cached copy of a file
+type CachedFile struct {
+	Path   string
+	Etag   string
+	Bytes  uint64
+	Open   bool
+	Pinned bool
+}
+
+// underPath reports whether key is path itself or, if recursive is set, anywhere below it.  Otherwise
+// only the entries directly in path match.
+func underPath(key string, path string, recursive bool) bool {
+	if key == path {
+		return true
+	}
+	if !recursive {
+		return parentPath(key) == path
+	}
+	return path == "" || strings.HasPrefix(key, path+"/")
+}
+
+// CachedFiles returns the cached files at path, and in the directory at path.  If recursive is set,
+// the files in every directory below path are included too.
+func (c *LocalCache) CachedFiles(path string, recursive bool) ([]*CachedFile, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	files := make([]*CachedFile, 0)
+	err := c.db.View(func(tx *bolt.Tx) error {
+		pins := tx.Bucket([]byte(PINS))
+		return tx.Bucket([]byte(FILE_MAP)).ForEach(func(k, v []byte) error {
+			if !underPath(string(k), path, recursive) {
+				return nil
+			}
+
+			e, err := decodeFileCacheEntry(v)
+			if err != nil {
+				return err
+			}
+			files = append(files, &CachedFile{Path: string(k), Etag: e.Etag, Bytes: e.Valid.total(),
+				Open: c.open[string(k)] > 0, Pinned: isPinned(pins, string(k))})
+			return nil
+		})
+	})
+	return files, err
+}
+
+// DropListDirs deletes the cached listing of the directory at path, and of every directory below it
+// if recursive is set, so they are fetched from the backend when next needed.  Returns the number of
+// listings deleted.
+func (c *LocalCache) DropListDirs(path string, recursive bool) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	dropped := 0
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(DIR_MAP))
+
+		keys := make([][]byte, 0)
+		err := b.ForEach(func(k, v []byte) error {
+			key := string(k)
+			if key == "/" {
+				// the root's listing is stored under "/" rather than ""
+				key = ""
+			}
+			if key == path || (recursive && underPath(key, path, true)) {
+				keys = append(keys, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			err = b.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+		dropped = len(keys)
+		return nil
+	})
+	return dropped, err
+}
+
+// EvictOptions controls FS.Evict.  Files which are open are skipped, unless WaitForOpen is set in which
+// case Evict waits for them to be closed.  DropListings also deletes the cached directory listings,
+// of the directory at the path or, if Recursive is set, of every directory below it as well.
+type EvictOptions struct {
+	Recursive    bool
+	DropListings bool
+	WaitForOpen  bool
+}
+
+// EvictSummary describes what FS.Evict removed
+type EvictSummary struct {
+	Files         int
+	Bytes         uint64
+	SkippedOpen   int
+	SkippedPinned int
+	Listings      int
+}
+
+const openPollInterval = 100 * time.Millisecond
+
+var FileIsOpen error = errors.New("File is open")
+
+// EvictClosedFile removes the cached copy of path like EvictFile, unless the file is open.  The check
+// is made under the same lock as the eviction, so the file can't be opened in between.
+func (c *LocalCache) EvictClosedFile(path string, etag string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.open[path] > 0 {
+		return FileIsOpen
+	}
+	return c.evictFile(path, etag)
+}
+
+// Evict removes the cached copies of path, or of the files in the directory at path, to free disk
+// space.  With options.Recursive, files in every directory below path are evicted too.  Pinned files
+// are skipped, as they must stay in the cache until they are unpinned.
+func (fs *FS) Evict(ctx context.Context, path string, options EvictOptions) (*EvictSummary, error) {
+	path = strings.Trim(path, "/")
+	summary := &EvictSummary{}
+
+	files, err := fs.cache.CachedFiles(path, options.Recursive)
+	if err != nil {
+		return summary, err
+	}
+
+	for _, file := range files {
+		if file.Pinned {
+			summary.SkippedPinned++
+			continue
+		}
+		err = fs.cache.EvictClosedFile(file.Path, file.Etag)
+		for err == FileIsOpen && options.WaitForOpen {
+			file, err = fs.waitUntilClosed(ctx, file.Path)
+			if err != nil {
+				return summary, err
+			}
+			if file == nil {
+				// evicted by someone else while we waited
+				err = NotInCache
+				break
+			}
+			err = fs.cache.EvictClosedFile(file.Path, file.Etag)
+		}
+		if err == FileIsOpen {
+			summary.SkippedOpen++
+			continue
+		} else if err == NotInCache {
+			continue
+		} else if err != nil {
+			return summary, err
+		}
+		fs.stats.IncFilesEvicted()
+		fs.stats.IncBytesEvicted(int64(file.Bytes))
+		summary.Files++
+		summary.Bytes += file.Bytes
+	}
+
+	if options.DropListings {
+		summary.Listings, err = fs.cache.DropListDirs(path, options.Recursive)
+		if err != nil {
+			return summary, err
+		}
+	}
+
+	return summary, nil
+}
+
+// waitUntilClosed polls until path is no longer open, and returns its cached copy then, or nil if it
+// is no longer cached
+func (fs *FS) waitUntilClosed(ctx context.Context, path string) (*CachedFile, error) {
+	fmt.Printf("Waiting for %s to be closed before evicting it\n", path)
+	for {
+		err := sleepContext(ctx, openPollInterval)
+		if err != nil {
+			return nil, err
+		}
+
+		files, err := fs.cache.CachedFiles(path, false)
+		if err != nil {
+			return nil, err
+		}
+
+		var file *CachedFile
+		for _, f := range files {
+			if f.Path == path {
+				file = f
+			}
+		}
+		if file == nil || !file.Open {
+			return file, nil
+		}
+	}
+}
@@ -0,0 +1,510 @@
+package singleply
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	. "gopkg.in/check.v1"
+)
+
+type FSSuite struct{}
+
+var _ = Suite(&FSSuite{})
+
+// recordingConn serves files whose contents are a function of the offset, and records each
+// region it was asked for
+type recordingConn struct {
+	lock     sync.Mutex
+	files    map[string]*FileStat
+	requests []Region
+}
+
+func newRecordingConn(files ...*FileStat) *recordingConn {
+	conn := &recordingConn{files: make(map[string]*FileStat)}
+	for _, f := range files {
+		conn.files[f.Name] = f
+	}
+	return conn
+}
+
+func contentAt(offset uint64) byte {
+	return byte(offset % 251)
+}
+
+func (c *recordingConn) ListDir(ctx context.Context, path string, status StatusCallback) (*DirEntries, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	files := make([]*FileStat, 0, len(c.files))
+	for _, f := range c.files {
+		copy := *f
+		files = append(files, &copy)
+	}
+	return &DirEntries{Files: files}, nil
+}
+
+func (c *recordingConn) PrepareForRead(ctx context.Context, path string, etag string, localPath string, offset uint64, length uint64, status StatusCallback) (*Region, error) {
+	c.lock.Lock()
+	c.requests = append(c.requests, Region{offset, length})
+	c.lock.Unlock()
+
+	buffer := make([]byte, length)
+	for i := range buffer {
+		buffer[i] = contentAt(offset + uint64(i))
+	}
+
+	f, err := os.OpenFile(localPath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	_, err = f.WriteAt(buffer, int64(offset))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Region{offset, length}, nil
+}
+
+func (c *recordingConn) takeRequests() []Region {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	requests := c.requests
+	c.requests = nil
+	return requests
+}
+
+func newTestFS(c *C, conn Connector, options *FSOptions) (*FS, *LocalCache) {
+	cache, err := NewLocalCache(c.MkDir())
+	c.Assert(err, IsNil)
+	return NewFileSystem(conn, cache, NewTracker(), &Stats{}, options), cache
+}
+
+func (s *FSSuite) TestCoalescesMissingRegions(c *C) {
+	conn := newRecordingConn(&FileStat{Name: "f", Size: 1000, Etag: "1"})
+	fs, cache := newTestFS(c, conn, &FSOptions{MaxGap: 50})
+	defer cache.Close()
+
+	localPath, err := cache.GetLocalFile("f", "1", 1000)
+	c.Assert(err, IsNil)
+
+	cache.AddedRegions("f", "1", 100, 10)
+	cache.AddedRegions("f", "1", 200, 100)
+
+	// the gap at 100 is small enough to re-download, the one at 200 is not
+	err = fs.PrepareForRead(context.Background(), "f", "1", localPath, 1000, 50, 300, PriorityRead, nil)
+	c.Assert(err, IsNil)
+	c.Assert(conn.takeRequests(), DeepEquals, []Region{{50, 150}, {300, 50}})
+
+	missing, err := cache.GetMissingRegions("f", "1", 0, 400)
+	c.Assert(err, IsNil)
+	c.Assert(missing, DeepEquals, []Region{{0, 50}, {350, 50}})
+
+	// with a large enough threshold everything is fetched in one request
+	fs.options.MaxGap = 1000
+	err = fs.PrepareForRead(context.Background(), "f", "1", localPath, 1000, 0, 400, PriorityRead, nil)
+	c.Assert(err, IsNil)
+	c.Assert(conn.takeRequests(), DeepEquals, []Region{{0, 400}})
+}
+
+func (s *FSSuite) TestBlockAlignedFetches(c *C) {
+	conn := newRecordingConn(&FileStat{Name: "f", Size: 250, Etag: "1"})
+	fs, cache := newTestFS(c, conn, &FSOptions{BlockSize: 100})
+	defer cache.Close()
+
+	localPath, err := cache.GetLocalFile("f", "1", 250)
+	c.Assert(err, IsNil)
+
+	err = fs.PrepareForRead(context.Background(), "f", "1", localPath, 250, 120, 10, PriorityRead, nil)
+	c.Assert(err, IsNil)
+	c.Assert(conn.takeRequests(), DeepEquals, []Region{{100, 100}})
+
+	// already present
+	err = fs.PrepareForRead(context.Background(), "f", "1", localPath, 250, 150, 50, PriorityRead, nil)
+	c.Assert(err, IsNil)
+	c.Assert(conn.takeRequests(), IsNil)
+
+	// the last block is clamped to the end of the file, and so are reads past the end
+	err = fs.PrepareForRead(context.Background(), "f", "1", localPath, 250, 190, 100, PriorityRead, nil)
+	c.Assert(err, IsNil)
+	c.Assert(conn.takeRequests(), DeepEquals, []Region{{200, 50}})
+
+	err = fs.PrepareForRead(context.Background(), "f", "1", localPath, 250, 300, 100, PriorityRead, nil)
+	c.Assert(err, IsNil)
+	c.Assert(conn.takeRequests(), IsNil)
+
+	missing, err := cache.GetMissingRegions("f", "1", 0, 250)
+	c.Assert(err, IsNil)
+	c.Assert(missing, DeepEquals, []Region{{0, 100}})
+}
+
+func (s *FSSuite) TestReadaheadWindow(c *C) {
+	var r readahead
+
+	// the first read only establishes a position
+	c.Assert(r.next(0, 10, 1000, 100, 400), IsNil)
+
+	// a second sequential read starts readahead with the minimum window
+	c.Assert(*r.next(10, 10, 1000, 100, 400), Equals, Region{20, 100})
+	r.done()
+
+	// nothing more is fetched until the reader is halfway through the window
+	c.Assert(r.next(20, 10, 1000, 100, 400), IsNil)
+	c.Assert(*r.next(30, 50, 1000, 100, 400), Equals, Region{120, 160})
+	r.done()
+
+	// a random read shrinks the window and stops readahead
+	c.Assert(r.next(500, 10, 1000, 100, 400), IsNil)
+	c.Assert(r.window, Equals, uint64(100))
+	c.Assert(r.next(510, 10, 1000, 100, 400), IsNil)
+
+	// once sequential again, the window keeps growing up to the maximum and is clamped to the file size
+	c.Assert(*r.next(520, 10, 1000, 100, 400), Equals, Region{530, 200})
+	r.done()
+	c.Assert(*r.next(530, 200, 1000, 100, 400), Equals, Region{730, 270})
+}
+
+// gatedConn holds each PrepareForRead until it is released, and then fails it with err if set
+type gatedConn struct {
+	*recordingConn
+	started chan bool
+	release chan bool
+	err     error
+}
+
+func (c *gatedConn) PrepareForRead(ctx context.Context, path string, etag string, localPath string, offset uint64, length uint64, status StatusCallback) (*Region, error) {
+	c.started <- true
+	<-c.release
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.recordingConn.PrepareForRead(ctx, path, etag, localPath, offset, length, status)
+}
+
+func waitForWaiters(c *C, stats *Stats, count int32) {
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&stats.WaitedOnFetchCount) < count {
+		c.Assert(time.Now().Before(deadline), Equals, true)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (s *FSSuite) TestConcurrentReadsShareFetch(c *C) {
+	for _, failure := range []error{nil, errors.New("backend failed")} {
+		conn := &gatedConn{recordingConn: newRecordingConn(), started: make(chan bool, 10), release: make(chan bool), err: failure}
+		fs, cache := newTestFS(c, conn, &FSOptions{})
+
+		localPath, err := cache.GetLocalFile("f", "1", 1000)
+		c.Assert(err, IsNil)
+
+		results := make(chan error)
+		go func() {
+			results <- fs.PrepareForRead(context.Background(), "f", "1", localPath, 1000, 0, 500, PriorityRead, nil)
+		}()
+		<-conn.started
+
+		// the second read is covered by the first, so it must wait for it rather than fetch
+		go func() {
+			results <- fs.PrepareForRead(context.Background(), "f", "1", localPath, 1000, 100, 100, PriorityRead, nil)
+		}()
+		waitForWaiters(c, fs.stats, 1)
+
+		close(conn.release)
+		c.Assert(<-results, Equals, failure)
+		c.Assert(<-results, Equals, failure)
+
+		if failure == nil {
+			c.Assert(conn.takeRequests(), DeepEquals, []Region{{0, 500}})
+		}
+		c.Assert(len(conn.started), Equals, 0)
+		cache.Close()
+	}
+}
+
+func (s *FSSuite) TestParallelPartsKeepSuccesses(c *C) {
+	conn := &failingConn{recordingConn: newRecordingConn(), failAt: 200, failure: errors.New("part failed")}
+	fs, cache := newTestFS(c, conn, &FSOptions{BlockSize: 50, ParallelParts: 4, MinPartSize: 60})
+	defer cache.Close()
+
+	localPath, err := cache.GetLocalFile("f", "1", 1000)
+	c.Assert(err, IsNil)
+
+	// 400 bytes split 4 ways, rounded up to whole blocks
+	err = fs.PrepareForRead(context.Background(), "f", "1", localPath, 1000, 0, 400, PriorityRead, nil)
+	c.Assert(err, Equals, conn.failure)
+
+	requests := conn.takeRequests()
+	sort.Sort(byOffset(requests))
+	c.Assert(requests, DeepEquals, []Region{{0, 100}, {100, 100}, {300, 100}})
+
+	missing, err := cache.GetMissingRegions("f", "1", 0, 400)
+	c.Assert(err, IsNil)
+	c.Assert(missing, DeepEquals, []Region{{200, 100}})
+
+	data, err := ioutil.ReadFile(localPath)
+	c.Assert(err, IsNil)
+	c.Assert(data[399], Equals, contentAt(399))
+}
+
+// failingConn fails any request for the region starting at failAt
+type failingConn struct {
+	*recordingConn
+	failAt  uint64
+	failure error
+}
+
+func (c *failingConn) PrepareForRead(ctx context.Context, path string, etag string, localPath string, offset uint64, length uint64, status StatusCallback) (*Region, error) {
+	if offset == c.failAt {
+		return nil, c.failure
+	}
+	return c.recordingConn.PrepareForRead(ctx, path, etag, localPath, offset, length, status)
+}
+
+type byOffset []Region
+
+func (a byOffset) Len() int           { return len(a) }
+func (a byOffset) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byOffset) Less(i, j int) bool { return a[i].Offset < a[j].Offset }
+
+func (s *FSSuite) TestSchedulerRunsInPriorityOrder(c *C) {
+	stats := &Stats{}
+	scheduler := NewScheduler(1, stats)
+
+	// occupy the only worker so everything else queues up behind it
+	release := make(chan bool)
+	started := make(chan bool)
+	go scheduler.Run(context.Background(), &jobGroup{priority: PriorityRead}, nil, func() {
+		started <- true
+		<-release
+	})
+	<-started
+
+	var lock sync.Mutex
+	order := make([]string, 0)
+	var wg sync.WaitGroup
+	submit := func(name string, group *jobGroup) {
+		wg.Add(1)
+		go scheduler.Run(context.Background(), group, nil, func() {
+			lock.Lock()
+			order = append(order, name)
+			lock.Unlock()
+			wg.Done()
+		})
+	}
+	waitForQueued := func(count int32) {
+		deadline := time.Now().Add(5 * time.Second)
+		for atomic.LoadInt32(&stats.QueuedReads)+atomic.LoadInt32(&stats.QueuedReadahead)+atomic.LoadInt32(&stats.QueuedPrefetch) < count {
+			c.Assert(time.Now().Before(deadline), Equals, true)
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	promoted := &jobGroup{priority: PriorityPrefetch}
+	submit("prefetch", &jobGroup{priority: PriorityPrefetch})
+	waitForQueued(1)
+	submit("promoted", promoted)
+	waitForQueued(2)
+	submit("readahead", &jobGroup{priority: PriorityReadahead})
+	waitForQueued(3)
+	submit("read", &jobGroup{priority: PriorityRead})
+	waitForQueued(4)
+
+	c.Assert(atomic.LoadInt32(&stats.QueuedPrefetch), Equals, int32(2))
+	scheduler.promote(promoted, PriorityReadahead)
+	c.Assert(atomic.LoadInt32(&stats.QueuedPrefetch), Equals, int32(1))
+	c.Assert(atomic.LoadInt32(&stats.QueuedReadahead), Equals, int32(2))
+
+	close(release)
+	wg.Wait()
+	c.Assert(order, DeepEquals, []string{"read", "promoted", "readahead", "prefetch"})
+	c.Assert(atomic.LoadInt32(&stats.QueuedReadahead), Equals, int32(0))
+}
+
+// unreachableConn fails every call with a connection error while down is set
+type unreachableConn struct {
+	*recordingConn
+	down bool
+}
+
+func (c *unreachableConn) err() error {
+	return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+}
+
+func (c *unreachableConn) ListDir(ctx context.Context, path string, status StatusCallback) (*DirEntries, error) {
+	if c.down {
+		return nil, c.err()
+	}
+	return c.recordingConn.ListDir(ctx, path, status)
+}
+
+func (c *unreachableConn) PrepareForRead(ctx context.Context, path string, etag string, localPath string, offset uint64, length uint64, status StatusCallback) (*Region, error) {
+	if c.down {
+		return nil, c.err()
+	}
+	return c.recordingConn.PrepareForRead(ctx, path, etag, localPath, offset, length, status)
+}
+
+func (s *FSSuite) TestOfflineServesFromCache(c *C) {
+	conn := &unreachableConn{recordingConn: newRecordingConn(&FileStat{Name: "f", Size: 1000, Etag: "1"})}
+	fs, cache := newTestFS(c, conn, &FSOptions{BlockSize: 100})
+	defer cache.Close()
+
+	files, err := fs.ListDir(context.Background(), "")
+	c.Assert(err, IsNil)
+	localPath, err := cache.GetLocalFile("f", "1", 1000)
+	c.Assert(err, IsNil)
+	err = fs.PrepareForRead(context.Background(), "f", "1", localPath, 1000, 0, 150, PriorityRead, nil)
+	c.Assert(err, IsNil)
+
+	conn.down = true
+	c.Assert(cache.Invalidate("/"), IsNil)
+
+	// the stale listing is served
+	offlineFiles, err := fs.ListDir(context.Background(), "")
+	c.Assert(err, IsNil)
+	c.Assert(offlineFiles.Files, DeepEquals, files.Files)
+	c.Assert(fs.IsOffline(), Equals, true)
+
+	// the first read fetched the whole of its last block, so reads within it still work
+	err = fs.PrepareForRead(context.Background(), "f", "1", localPath, 1000, 150, 50, PriorityRead, nil)
+	c.Assert(err, IsNil)
+	err = fs.PrepareForRead(context.Background(), "f", "1", localPath, 1000, 150, 60, PriorityRead, nil)
+	c.Assert(err, Equals, fuse.EIO)
+
+	// a directory which was never listed has nothing to fall back on
+	_, err = fs.ListDir(context.Background(), "other")
+	c.Assert(err, NotNil)
+
+	conn.down = false
+	err = fs.PrepareForRead(context.Background(), "f", "1", localPath, 1000, 150, 60, PriorityRead, nil)
+	c.Assert(err, IsNil)
+	c.Assert(fs.IsOffline(), Equals, false)
+	c.Assert(fs.stats.OfflineFallbackCount, Equals, int32(1))
+}
+
+// stallingConn writes the first half of the first region it is asked for, and then blocks until
+// the caller gives up
+type stallingConn struct {
+	*recordingConn
+	started chan bool
+	stalled int32
+}
+
+func (c *stallingConn) PrepareForRead(ctx context.Context, path string, etag string, localPath string, offset uint64, length uint64, status StatusCallback) (*Region, error) {
+	if !atomic.CompareAndSwapInt32(&c.stalled, 0, 1) {
+		return c.recordingConn.PrepareForRead(ctx, path, etag, localPath, offset, length, status)
+	}
+
+	prepared, err := c.recordingConn.PrepareForRead(ctx, path, etag, localPath, offset, length/2, status)
+	if err != nil {
+		return prepared, err
+	}
+	c.started <- true
+	<-ctx.Done()
+	return prepared, ctx.Err()
+}
+
+func (s *FSSuite) TestCancelledReadKeepsPartialData(c *C) {
+	conn := &stallingConn{recordingConn: newRecordingConn(), started: make(chan bool, 1)}
+	fs, cache := newTestFS(c, conn, &FSOptions{})
+	defer cache.Close()
+
+	localPath, err := cache.GetLocalFile("f", "1", 1000)
+	c.Assert(err, IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	results := make(chan error)
+	go func() {
+		results <- fs.PrepareForRead(ctx, "f", "1", localPath, 1000, 0, 400, PriorityRead, nil)
+	}()
+	<-conn.started
+
+	// the second read waits on the first, and has to fetch for itself once the first gives up
+	waiter := make(chan error)
+	go func() {
+		waiter <- fs.PrepareForRead(context.Background(), "f", "1", localPath, 1000, 250, 50, PriorityRead, nil)
+	}()
+	waitForWaiters(c, fs.stats, 1)
+
+	cancel()
+	c.Assert(<-results, Equals, context.Canceled)
+	c.Assert(<-waiter, IsNil)
+
+	c.Assert(conn.takeRequests(), DeepEquals, []Region{{0, 200}, {250, 50}})
+	missing, err := cache.GetMissingRegions("f", "1", 0, 400)
+	c.Assert(err, IsNil)
+	c.Assert(missing, DeepEquals, []Region{{200, 50}, {300, 100}})
+	c.Assert(fuseError(context.Canceled), Equals, fuse.EINTR)
+}
+
+func (s *FSSuite) TestSchedulerDropsCancelledJobs(c *C) {
+	stats := &Stats{}
+	scheduler := NewScheduler(1, stats)
+
+	release := make(chan bool)
+	started := make(chan bool)
+	go scheduler.Run(context.Background(), &jobGroup{priority: PriorityRead}, nil, func() {
+		started <- true
+		<-release
+	})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	ran := false
+	err := scheduler.Run(ctx, &jobGroup{priority: PriorityRead}, nil, func() { ran = true })
+	c.Assert(err, Equals, context.DeadlineExceeded)
+	c.Assert(atomic.LoadInt32(&stats.QueuedReads), Equals, int32(0))
+
+	close(release)
+	c.Assert(scheduler.Run(context.Background(), &jobGroup{priority: PriorityRead}, nil, func() {}), IsNil)
+	c.Assert(ran, Equals, false)
+}
+
+func (s *FSSuite) TestEvict(c *C) {
+	conn := newTreeConn()
+	fs, cache := newTestFS(c, conn, &FSOptions{BlockSize: 100})
+	defer cache.Close()
+
+	err := fs.Prefetch(context.Background(), "", PrefetchOptions{Recursive: true}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(cache.Pin("top"), IsNil)
+
+	// only the files directly in the directory are evicted without recursion
+	summary, err := fs.Evict(context.Background(), "d", EvictOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(*summary, Equals, EvictSummary{Files: 1, Bytes: 300})
+
+	_, err = cache.GetLocalFile("d/a", "1", 300)
+	c.Assert(err, IsNil)
+	cache.AddedRegions("d/a", "1", 0, 100)
+	cache.FileOpened("d/a")
+	summary, err = fs.Evict(context.Background(), "", EvictOptions{Recursive: true, DropListings: true})
+	c.Assert(err, IsNil)
+	c.Assert(*summary, Equals, EvictSummary{Files: 1, Bytes: 50, SkippedOpen: 1, SkippedPinned: 1, Listings: 3})
+	c.Assert(fs.stats.BytesEvicted, Equals, int64(350))
+
+	listing, err := cache.GetListDir("d/e")
+	c.Assert(err, IsNil)
+	c.Assert(listing, IsNil)
+
+	// waiting evicts open files once they are closed
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cache.FileClosed("d/a")
+	}()
+	summary, err = fs.Evict(context.Background(), "d/a", EvictOptions{WaitForOpen: true})
+	c.Assert(err, IsNil)
+	c.Assert(*summary, Equals, EvictSummary{Files: 1, Bytes: 100})
+}
@@ -0,0 +1,141 @@
+package singleply
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// FsckReport counts the problems Fsck found and repaired
+type FsckReport struct {
+	// entries which could not be decoded, or whose local file was gone.  These are removed.
+	CorruptEntries    int
+	MissingLocalFiles int
+
+	// entries with regions past the end of the file, or past what is actually in the local file.
+	// The regions are cut short.
+	ClippedEntries int
+
+	// local files which no entry refers to.  These are deleted.
+	OrphanedFiles int
+	BytesFreed    int64
+}
+
+func (r *FsckReport) Problems() int {
+	return r.CorruptEntries + r.MissingLocalFiles + r.ClippedEntries + r.OrphanedFiles
+}
+
+func (r *FsckReport) String() string {
+	if r.Problems() == 0 {
+		return "no problems found"
+	}
+	return fmt.Sprintf("removed %d corrupt entries and %d entries with missing local files, clipped regions of %d entries, deleted %d orphaned local files (%d bytes)",
+		r.CorruptEntries, r.MissingLocalFiles, r.ClippedEntries, r.OrphanedFiles, r.BytesFreed)
+}
+
+// Fsck checks that the database and the local files agree, and repairs any differences, such as those
+// left behind by a crash.  It should be run before the cache is used.
+func (c *LocalCache) Fsck() (*FsckReport, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	report := &FsckReport{}
+
+	err := c.deletePending()
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := make(map[string]bool)
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(FILE_MAP))
+		removed := make([]string, 0)
+		updated := make(map[string][]byte)
+
+		err := b.ForEach(func(k, v []byte) error {
+			e, err := decodeFileCacheEntry(v)
+			if err != nil {
+				fmt.Printf("fsck: removing entry for %s which could not be decoded: %s\n", string(k), err.Error())
+				report.CorruptEntries++
+				removed = append(removed, string(k))
+				return nil
+			}
+
+			info, err := os.Stat(e.LocalPath)
+			if os.IsNotExist(err) {
+				fmt.Printf("fsck: removing entry for %s whose local file %s is missing\n", string(k), e.LocalPath)
+				report.MissingLocalFiles++
+				removed = append(removed, string(k))
+				return nil
+			} else if err != nil {
+				return err
+			}
+			referenced[filepath.Clean(e.LocalPath)] = true
+
+			// bytes past the end of the local file never made it to disk.  Entries from before sizes
+			// were recorded have no etag, and can only be checked against the local file.
+			limit := uint64(info.Size())
+			if e.Etag != "" {
+				limit = min(limit, e.Size)
+			}
+			if e.Valid.clip(limit) {
+				fmt.Printf("fsck: clipping regions of %s to %d bytes\n", string(k), limit)
+				report.ClippedEntries++
+				encoded, err := encodeFileCacheEntry(e)
+				if err != nil {
+					return err
+				}
+				updated[string(k)] = encoded
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range removed {
+			err = b.Delete([]byte(k))
+			if err != nil {
+				return err
+			}
+			delete(c.accessed, k)
+			c.forgetUnsynced(k)
+		}
+		for k, v := range updated {
+			err = b.Put([]byte(k), v)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// local files are created by GetLocalFile with names starting with "l"
+	infos, err := ioutil.ReadDir(c.rootDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		localPath := filepath.Clean(filepath.Join(c.rootDir, info.Name()))
+		if !info.Mode().IsRegular() || !strings.HasPrefix(info.Name(), "l") || referenced[localPath] {
+			continue
+		}
+
+		fmt.Printf("fsck: deleting orphaned local file %s\n", localPath)
+		err = os.Remove(localPath)
+		if err != nil {
+			return nil, err
+		}
+		report.OrphanedFiles++
+		report.BytesFreed += info.Size()
+	}
+
+	return report, nil
+}
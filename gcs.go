@@ -9,10 +9,10 @@ import (
         storage "google.golang.org/api/storage/v1"
 )
 
-func listAllObjects(service *storage.ObjectsService, bucketName string, prefix string, callback func(objects *storage.Objects) error) error {
+func listAllObjects(ctx context.Context, service *storage.ObjectsService, bucketName string, prefix string, callback func(objects *storage.Objects) error) error {
         pageToken := ""
         for {
-                call := service.List(bucketName).Delimiter("/").Prefix(prefix)
+                call := service.List(bucketName).Delimiter("/").Prefix(prefix).Context(ctx)
                 if pageToken != "" {
                         call = call.PageToken(pageToken)
                 }
@@ -35,7 +35,7 @@ type GCSConnection struct {
 }
 
 
-func (c *GCSConnection) ListDir(path string, status StatusCallback) (*DirEntries, error) {
+func (c *GCSConnection) ListDir(ctx context.Context, path string, status StatusCallback) (*DirEntries, error) {
 	files := make([]*FileStat, 0, 100)
 	if path != "" {
 		path = path + "/"
@@ -48,7 +48,7 @@ func (c *GCSConnection) ListDir(path string, status StatusCallback) (*DirEntries
 	// filtering to avoid issues with both key and directry with same name
 	dirNames := make(map[string]string)
         
-	err := listAllObjects(c.service, c.bucket, prefix, func(objects *storage.Objects) error {
+	err := listAllObjects(ctx, c.service, c.bucket, prefix, func(objects *storage.Objects) error {
 		for _, p := range objects.Prefixes {
 			name := p
 			name = name[len(prefix) : len(name)-1]
@@ -74,7 +74,7 @@ func (c *GCSConnection) ListDir(path string, status StatusCallback) (*DirEntries
 				continue
 			}
 
-			files = append(files, &FileStat{Name: name, IsDir: isDir, Size: uint64(object.Size), Etag: object.Etag})
+			files = append(files, &FileStat{Name: name, IsDir: isDir, Size: uint64(object.Size), Etag: object.Etag, Checksum: gcsChecksum(object.Crc32c)})
 		}
 
 		return nil
@@ -82,7 +82,7 @@ func (c *GCSConnection) ListDir(path string, status StatusCallback) (*DirEntries
         })
 
 	if err != nil {
-		return nil, err
+		return nil, classifyGCSError(path, err)
 	}
 
 	return &DirEntries{Files: files}, nil
@@ -115,7 +115,7 @@ func NewGCSConnection(bucket string, prefix string) *GCSConnection {
 	return &GCSConnection{bucket: bucket, prefix: prefix, service: service.Objects}
 }
 
-func (c *GCSConnection) PrepareForRead(path string, etag string, localPath string, offset uint64, length uint64, status StatusCallback) (prepared *Region, err error) {
+func (c *GCSConnection) PrepareForRead(ctx context.Context, path string, etag string, localPath string, offset uint64, length uint64, status StatusCallback) (prepared *Region, err error) {
 	key := c.prefix + "/" + path
 
 	// TODO: Add
@@ -123,19 +123,16 @@ func (c *GCSConnection) PrepareForRead(path string, etag string, localPath strin
 	//	Key:   &key,
 	//	Range: aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))}
 	
-	res, err := c.service.Get(c.bucket, key).IfMatch(etag).Range(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)).Download()
+	res, err := c.service.Get(c.bucket, key).IfMatch(etag).Range(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)).Context(ctx).Download()
 
 	if err != nil {
-		if(isStatusCode(err, 412)) {
-			return nil, UpdateDetected
-		}
-		return nil, err
+		return nil, classifyGCSError(path, err)
 	}
 		
-	err = copyTo(localPath, offset, uint64(res.ContentLength), res.Body)
+	written, err := copyTo(ctx, localPath, offset, uint64(res.ContentLength), res.Body)
 	res.Body.Close()
 	if err != nil {
-		return nil, err
+		return &Region{offset, written}, classifyGCSError(path, err)
 	}
 
 	return &Region{offset, uint64(res.ContentLength)}, err
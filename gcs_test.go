@@ -49,7 +49,7 @@ func (s *GCSSuite) TestGCSSuite(c *C) {
 	// Create GCS connection to test operations	
 	connection := NewGCSConnection(bucket, prefix)
 	status := &NullStatusCallback{}
-	files, err := connection.ListDir("", status)
+	files, err := connection.ListDir(context.Background(), "", status)
 	c.Assert(len(files.Files) >= 1, Equals, true)
 	
 	var found *FileStat
@@ -65,7 +65,7 @@ func (s *GCSSuite) TestGCSSuite(c *C) {
 	localPath := c.MkDir()+"/dest"
 	ioutil.WriteFile(localPath, make([]byte, 0), 0700)	
 	
-	region, err := connection.PrepareForRead("sample", found.Etag, localPath, 0, 10, status)
+	region, err := connection.PrepareForRead(context.Background(), "sample", found.Etag, localPath, 0, 10, status)
 	c.Assert(err, IsNil)
 	c.Assert(region.Offset, Equals, uint64(0))
 	c.Assert(region.Length, Equals, uint64(10))
@@ -0,0 +1,345 @@
+package singleply
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// HTTPStatusError is returned when an HTTP server responds with an unexpected status
+type HTTPStatusError struct {
+	StatusCode int
+	URL        string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("%s returned status %d", e.URL, e.StatusCode)
+}
+
+// Errno reports statuses which mean the same as one of the BackendError kinds with the same errno
+func (e *HTTPStatusError) Errno() fuse.Errno {
+	if kind, ok := statusKind(e.StatusCode); ok {
+		return (&BackendError{Kind: kind}).Errno()
+	}
+	return fuse.EIO
+}
+
+// ManifestEntry describes one file in a JSON manifest.  A manifest is a JSON array of these, with
+// paths relative to the base URL.  MD5 is the optional hex digest of the file's contents.
+type ManifestEntry struct {
+	Path string `json:"path"`
+	Size uint64 `json:"size"`
+	Etag string `json:"etag"`
+	MD5  string `json:"md5,omitempty"`
+}
+
+// HTTPConnection serves files published on a plain HTTP or HTTPS server.  Directory listings come
+// from a JSON manifest if one is configured, otherwise from the server's autoindex pages.  Sizes and
+// etags come from HEAD requests, and reads are ranged GETs.
+type HTTPConnection struct {
+	baseURL     string
+	manifestURL string
+	client      *http.Client
+
+	lock         sync.Mutex
+	manifestEtag string
+	manifestDirs map[string]*DirEntries
+}
+
+// lastModifiedPrefix marks etags which were made up from Last-Modified and Content-Length because
+// the server did not send an ETag
+const lastModifiedPrefix = "lm:"
+
+func NewHTTPConnection(baseURL string, manifestURL string) *HTTPConnection {
+	return &HTTPConnection{baseURL: strings.TrimRight(baseURL, "/"), manifestURL: manifestURL, client: http.DefaultClient}
+}
+
+func (c *HTTPConnection) url(path string, isDir bool) string {
+	escaped := (&url.URL{Path: path}).String()
+	if escaped != "" {
+		escaped = "/" + escaped
+	}
+	if isDir {
+		escaped = escaped + "/"
+	}
+	return c.baseURL + escaped
+}
+
+// do sends req, which must have been built with ctx so it is abandoned once ctx is done
+func (c *HTTPConnection) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	resp, err := c.client.Do(req)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return resp, err
+}
+
+// send makes a request with no body
+func (c *HTTPConnection) send(ctx context.Context, method string, target string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(ctx, req)
+}
+
+func (c *HTTPConnection) ListDir(ctx context.Context, path string, status StatusCallback) (*DirEntries, error) {
+	if c.manifestURL != "" {
+		return c.listManifestDir(ctx, path)
+	}
+	return c.listIndexDir(ctx, path, status)
+}
+
+// loadManifest fetches the manifest if it has changed since it was last fetched, and splits it into
+// a listing per directory.  Must be called with lock held.
+func (c *HTTPConnection) loadManifest(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.manifestURL, nil)
+	if err != nil {
+		return err
+	}
+	if c.manifestEtag != "" {
+		req.Header.Set("If-None-Match", c.manifestEtag)
+	}
+
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && c.manifestDirs != nil {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &HTTPStatusError{StatusCode: resp.StatusCode, URL: c.manifestURL}
+	}
+
+	var entries []ManifestEntry
+	err = json.NewDecoder(&contextReader{ctx: ctx, r: resp.Body}).Decode(&entries)
+	if err != nil {
+		return err
+	}
+
+	dirs := make(map[string]*DirEntries)
+	dirs[""] = &DirEntries{Files: make([]*FileStat, 0)}
+	for _, entry := range entries {
+		components := strings.Split(strings.Trim(entry.Path, "/"), "/")
+		parent := ""
+		for i, name := range components {
+			listing, ok := dirs[parent]
+			if !ok {
+				listing = &DirEntries{Files: make([]*FileStat, 0)}
+				dirs[parent] = listing
+			}
+
+			isDir := i < len(components)-1
+			if listing.Get(name) == nil {
+				if isDir {
+					listing.Files = append(listing.Files, &FileStat{Name: name, IsDir: true, Size: uint64(0)})
+				} else {
+					stat := &FileStat{Name: name, IsDir: false, Size: entry.Size, Etag: entry.Etag}
+					if entry.MD5 != "" {
+						stat.Checksum = "md5:" + strings.ToLower(entry.MD5)
+					}
+					listing.Files = append(listing.Files, stat)
+				}
+			}
+
+			if parent == "" {
+				parent = name
+			} else {
+				parent = parent + "/" + name
+			}
+		}
+	}
+
+	c.manifestDirs = dirs
+	c.manifestEtag = resp.Header.Get("ETag")
+	return nil
+}
+
+func (c *HTTPConnection) listManifestDir(ctx context.Context, path string) (*DirEntries, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	err := c.loadManifest(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	listing, ok := c.manifestDirs[path]
+	if !ok {
+		return nil, &HTTPStatusError{StatusCode: http.StatusNotFound, URL: c.url(path, true)}
+	}
+
+	files := make([]*FileStat, len(listing.Files))
+	for i, f := range listing.Files {
+		copy := *f
+		files[i] = &copy
+	}
+	return &DirEntries{Files: files}, nil
+}
+
+var hrefPattern = regexp.MustCompile(`(?i)<a\s[^>]*href\s*=\s*"([^"]*)"`)
+
+// parseIndex extracts the names of the entries in an autoindex page.  Names of directories end in "/".
+func parseIndex(page string) []string {
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, match := range hrefPattern.FindAllStringSubmatch(page, -1) {
+		href := match[1]
+		// skip sorting links, parent links, absolute links and anything else outside this directory
+		if href == "" || strings.ContainsAny(href[:1], "?#/.") || strings.Contains(href, "://") {
+			continue
+		}
+		href = strings.SplitN(strings.SplitN(href, "?", 2)[0], "#", 2)[0]
+
+		name, err := url.QueryUnescape(strings.Replace(href, "+", "%2B", -1))
+		if err != nil || strings.Contains(strings.TrimSuffix(name, "/"), "/") || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+func (c *HTTPConnection) listIndexDir(ctx context.Context, path string, status StatusCallback) (*DirEntries, error) {
+	dirURL := c.url(path, true)
+	resp, err := c.send(ctx, "GET", dirURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HTTPStatusError{StatusCode: resp.StatusCode, URL: dirURL}
+	}
+
+	page, err := ioutil.ReadAll(&contextReader{ctx: ctx, r: resp.Body})
+	if err != nil {
+		return nil, err
+	}
+
+	names := parseIndex(string(page))
+	files := make([]*FileStat, 0, len(names))
+	for i, name := range names {
+		if strings.HasSuffix(name, "/") {
+			files = append(files, &FileStat{Name: strings.TrimSuffix(name, "/"), IsDir: true, Size: uint64(0)})
+			continue
+		}
+
+		if status != nil {
+			status.SetStatus(fmt.Sprintf("HEAD %d of %d", i+1, len(names)))
+		}
+
+		childPath := name
+		if path != "" {
+			childPath = path + "/" + name
+		}
+		stat, err := c.head(ctx, childPath)
+		if err != nil {
+			return nil, err
+		}
+		stat.Name = name
+		files = append(files, stat)
+	}
+
+	return &DirEntries{Files: files}, nil
+}
+
+func (c *HTTPConnection) head(ctx context.Context, path string) (*FileStat, error) {
+	fileURL := c.url(path, false)
+	resp, err := c.send(ctx, "HEAD", fileURL)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HTTPStatusError{StatusCode: resp.StatusCode, URL: fileURL}
+	}
+	if resp.ContentLength < 0 {
+		return nil, fmt.Errorf("%s did not report a Content-Length", fileURL)
+	}
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		etag = lastModifiedPrefix + resp.Header.Get("Last-Modified") + ":" + strconv.FormatInt(resp.ContentLength, 10)
+	}
+
+	return &FileStat{IsDir: false, Size: uint64(resp.ContentLength), Etag: etag}, nil
+}
+
+// setPrecondition makes the request fail with 412 if the file no longer matches etag
+func setPrecondition(req *http.Request, etag string) {
+	if strings.HasPrefix(etag, lastModifiedPrefix) {
+		lastModified := strings.TrimPrefix(etag, lastModifiedPrefix)
+		lastModified = lastModified[:strings.LastIndex(lastModified, ":")]
+		if _, err := time.Parse(http.TimeFormat, lastModified); err == nil {
+			req.Header.Set("If-Unmodified-Since", lastModified)
+		}
+	} else if etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
+}
+
+func (c *HTTPConnection) PrepareForRead(ctx context.Context, path string, etag string, localPath string, offset uint64, length uint64, status StatusCallback) (prepared *Region, err error) {
+	fileURL := c.url(path, false)
+	req, err := http.NewRequestWithContext(ctx, "GET", fileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	setPrecondition(req, etag)
+
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// servers which ignore If-Match still report the current ETag, so check it here too.  Files listed
+	// in a manifest without an etag can't be checked.
+	currentEtag := resp.Header.Get("ETag")
+	checkEtag := etag != "" && !strings.HasPrefix(etag, lastModifiedPrefix)
+	if resp.StatusCode == http.StatusPreconditionFailed || (currentEtag != "" && checkEtag && currentEtag != etag) {
+		return nil, UpdateDetected
+	}
+
+	var body io.Reader
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		body = resp.Body
+	case http.StatusOK:
+		// the server ignored the range and is sending the whole file
+		_, err = io.CopyN(ioutil.Discard, &contextReader{ctx: ctx, r: resp.Body}, int64(offset))
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		body = io.LimitReader(resp.Body, int64(length))
+	default:
+		return nil, &HTTPStatusError{StatusCode: resp.StatusCode, URL: fileURL}
+	}
+
+	written, err := copyTo(ctx, localPath, offset, length, ioutil.NopCloser(body))
+	if err != nil {
+		return &Region{offset, written}, err
+	}
+
+	return &Region{offset, length}, nil
+}
@@ -0,0 +1,112 @@
+package singleply
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+	. "gopkg.in/check.v1"
+)
+
+type HTTPSuite struct{}
+
+var _ = Suite(&HTTPSuite{})
+
+func (s *HTTPSuite) TestAutoindex(c *C) {
+	root := c.MkDir()
+	c.Assert(os.Mkdir(root+"/sample dir", 0700), IsNil)
+	c.Assert(ioutil.WriteFile(root+"/sample dir/a+b", []byte("0123456789"), 0600), IsNil)
+	c.Assert(ioutil.WriteFile(root+"/banana", make([]byte, 100), 0600), IsNil)
+
+	server := httptest.NewServer(http.FileServer(http.Dir(root)))
+	defer server.Close()
+
+	conn := NewHTTPConnection(server.URL+"/", "")
+	files, err := conn.ListDir(context.Background(), "", nil)
+	c.Assert(err, IsNil)
+	c.Assert(len(files.Files), Equals, 2)
+	c.Assert(files.Get("sample dir").IsDir, Equals, true)
+	c.Assert(files.Get("banana").Size, Equals, uint64(100))
+
+	files, err = conn.ListDir(context.Background(), "sample dir", nil)
+	c.Assert(err, IsNil)
+	c.Assert(len(files.Files), Equals, 1)
+	f := files.Get("a+b")
+	c.Assert(f.Size, Equals, uint64(10))
+
+	localPath := c.MkDir() + "/dest"
+	c.Assert(ioutil.WriteFile(localPath, []byte{}, 0600), IsNil)
+
+	region, err := conn.PrepareForRead(context.Background(), "sample dir/a+b", f.Etag, localPath, 2, 5, nil)
+	c.Assert(err, IsNil)
+	c.Assert(*region, Equals, Region{2, 5})
+	data, err := ioutil.ReadFile(localPath)
+	c.Assert(err, IsNil)
+	c.Assert(string(data[2:]), Equals, "23456")
+
+	// the file server sends no ETag, so changes are detected through the modification time
+	later := time.Now().Add(time.Hour)
+	c.Assert(os.Chtimes(root+"/sample dir/a+b", later, later), IsNil)
+	_, err = conn.PrepareForRead(context.Background(), "sample dir/a+b", f.Etag, localPath, 0, 5, nil)
+	c.Assert(err, Equals, UpdateDetected)
+}
+
+func (s *HTTPSuite) TestManifest(c *C) {
+	content := []byte("0123456789")
+	etag := `"v1"`
+	manifestRequests := 0
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/manifest.json", func(w http.ResponseWriter, r *http.Request) {
+		manifestRequests++
+		w.Header().Set("ETag", `"m1"`)
+		if r.Header.Get("If-None-Match") == `"m1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		json.NewEncoder(w).Encode([]ManifestEntry{
+			{Path: "dir/sub/file", Size: uint64(len(content)), Etag: etag},
+			{Path: "top", Size: 5, Etag: `"t"`}})
+	})
+	mux.HandleFunc("/dir/sub/file", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(content))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	conn := NewHTTPConnection(server.URL, server.URL+"/manifest.json")
+	files, err := conn.ListDir(context.Background(), "", nil)
+	c.Assert(err, IsNil)
+	c.Assert(len(files.Files), Equals, 2)
+	c.Assert(files.Get("dir").IsDir, Equals, true)
+	c.Assert(files.Get("top").Size, Equals, uint64(5))
+
+	files, err = conn.ListDir(context.Background(), "dir/sub", nil)
+	c.Assert(err, IsNil)
+	c.Assert(*files.Get("file"), Equals, FileStat{Name: "file", Size: 10, Etag: etag})
+	c.Assert(manifestRequests, Equals, 2)
+
+	_, err = conn.ListDir(context.Background(), "missing", nil)
+	c.Assert(err, NotNil)
+
+	localPath := c.MkDir() + "/dest"
+	c.Assert(ioutil.WriteFile(localPath, []byte{}, 0600), IsNil)
+	region, err := conn.PrepareForRead(context.Background(), "dir/sub/file", etag, localPath, 5, 5, nil)
+	c.Assert(err, IsNil)
+	c.Assert(*region, Equals, Region{5, 5})
+
+	etag = `"v2"`
+	_, err = conn.PrepareForRead(context.Background(), "dir/sub/file", `"v1"`, localPath, 0, 5, nil)
+	c.Assert(err, Equals, UpdateDetected)
+
+	// manifest entries without an etag can't be checked against what the server sends
+	region, err = conn.PrepareForRead(context.Background(), "dir/sub/file", "", localPath, 0, 5, nil)
+	c.Assert(err, IsNil)
+	c.Assert(*region, Equals, Region{0, 5})
+}
@@ -0,0 +1,219 @@
+package singleply
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// BackendIdentity says which backend a cache holds data from.  Two connectors with the same identity
+// serve the same files.
+type BackendIdentity struct {
+	Type     string
+	Endpoint string
+	Bucket   string
+	Prefix   string
+}
+
+func (i BackendIdentity) String() string {
+	s := i.Type
+	if i.Endpoint != "" {
+		s = s + " " + i.Endpoint
+	}
+	return fmt.Sprintf("%s %s/%s", s, i.Bucket, i.Prefix)
+}
+
+// IdentifiedConnector is implemented by Connectors which can say which backend they serve
+type IdentifiedConnector interface {
+	Identity() BackendIdentity
+}
+
+// ConnectorIdentity returns the identity of connector, or one made up from its type if it has none
+func ConnectorIdentity(connector Connector) BackendIdentity {
+	if identified, ok := connector.(IdentifiedConnector); ok {
+		return identified.Identity()
+	}
+	return BackendIdentity{Type: fmt.Sprintf("%T", connector)}
+}
+
+func (c *S3Connection) Identity() BackendIdentity {
+	return BackendIdentity{Type: "s3", Endpoint: c.endpoint, Bucket: c.bucket, Prefix: c.prefix}
+}
+
+func (c *GCSConnection) Identity() BackendIdentity {
+	return BackendIdentity{Type: "gcs", Bucket: c.bucket, Prefix: c.prefix}
+}
+
+func (c *LocalDirConnector) Identity() BackendIdentity {
+	root, err := filepath.Abs(c.root)
+	if err != nil {
+		root = c.root
+	}
+	return BackendIdentity{Type: "local", Prefix: root}
+}
+
+func (c *HTTPConnection) Identity() BackendIdentity {
+	return BackendIdentity{Type: "http", Endpoint: c.baseURL}
+}
+
+func (c *MockConn) Identity() BackendIdentity {
+	return BackendIdentity{Type: "mock"}
+}
+
+func (c *RetryingConnector) Identity() BackendIdentity {
+	return ConnectorIdentity(c.connector)
+}
+
+func (c *RateLimitedConnector) Identity() BackendIdentity {
+	return ConnectorIdentity(c.connector)
+}
+
+var identityKey = []byte("identity")
+
+const DefaultNamespace = "default"
+
+// IdentityMismatchError is returned when opening a namespace which holds data from another backend
+type IdentityMismatchError struct {
+	Namespace string
+	Cached    BackendIdentity
+	Requested BackendIdentity
+}
+
+func (e *IdentityMismatchError) Error() string {
+	return fmt.Sprintf("Cache namespace \"%s\" holds data from %s, not %s.  Use a different namespace, or wipe it.", e.Namespace, e.Cached, e.Requested)
+}
+
+// Identity returns the identity of the backend the cache was filled from, or nil if it has not been
+// recorded
+func (c *LocalCache) Identity() (*BackendIdentity, error) {
+	var identity *BackendIdentity
+	err := c.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket([]byte(META)).Get(identityKey)
+		if value == nil {
+			return nil
+		}
+		identity = &BackendIdentity{}
+		return json.Unmarshal(value, identity)
+	})
+	return identity, err
+}
+
+func (c *LocalCache) setIdentity(identity BackendIdentity) error {
+	value, err := json.Marshal(identity)
+	if err != nil {
+		return err
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(META)).Put(identityKey, value)
+	})
+}
+
+// removeLegacyCache deletes the cache which versions without namespaces kept directly in rootDir.  It
+// doesn't say which backend its data came from, so it can't be moved into a namespace.
+func removeLegacyCache(rootDir string) error {
+	dbPath := filepath.Join(rootDir, "db")
+
+	// fails if a process which predates namespaces still has it open
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	db.Close()
+
+	localFiles, err := filepath.Glob(filepath.Join(rootDir, "l*"))
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for _, localFile := range localFiles {
+		info, err := os.Lstat(localFile)
+		if err != nil || !info.Mode().IsRegular() {
+			// namespaces are directories, and may have names starting with "l"
+			continue
+		}
+		err = os.Remove(localFile)
+		if err != nil {
+			return err
+		}
+		removed++
+	}
+
+	fmt.Printf("Removed the cache in %s from before namespaces were supported (%d files)\n", rootDir, removed)
+	return os.Remove(dbPath)
+}
+
+// OpenNamespacedCache opens the cache for one namespace in rootDir.  Each namespace lives in its own
+// subdirectory and is tagged with the identity of the backend it holds data from.  Opening a
+// namespace tagged with a different identity fails with IdentityMismatchError, unless wipe is set in
+// which case everything in the namespace is deleted first.
+func OpenNamespacedCache(rootDir string, namespace string, identity BackendIdentity, wipe bool) (*LocalCache, error) {
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	if strings.ContainsAny(namespace, `/\`) || namespace == "." || namespace == ".." {
+		return nil, fmt.Errorf("Invalid cache namespace \"%s\"", namespace)
+	}
+
+	if _, err := os.Stat(filepath.Join(rootDir, "db")); err == nil {
+		err = removeLegacyCache(rootDir)
+		if err != nil {
+			fmt.Printf("Could not remove the cache in %s from before namespaces were supported: %s.  "+
+				"It is no longer used, so delete %s and the files matching %s to free its space.\n",
+				rootDir, err.Error(), filepath.Join(rootDir, "db"), filepath.Join(rootDir, "l*"))
+		}
+	}
+
+	dir := filepath.Join(rootDir, namespace)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	cache, err := NewLocalCache(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	cached, err := cache.Identity()
+	if err != nil {
+		cache.Close()
+		return nil, err
+	}
+
+	if cached != nil && *cached != identity {
+		cache.Close()
+		if !wipe {
+			return nil, &IdentityMismatchError{Namespace: namespace, Cached: *cached, Requested: identity}
+		}
+
+		fmt.Printf("Wiping cache namespace \"%s\" which held data from %s\n", namespace, *cached)
+		err = os.RemoveAll(dir)
+		if err != nil {
+			return nil, err
+		}
+		err = os.MkdirAll(dir, 0700)
+		if err != nil {
+			return nil, err
+		}
+		cache, err = NewLocalCache(dir)
+		if err != nil {
+			return nil, err
+		}
+		cached = nil
+	}
+
+	if cached == nil {
+		err = cache.setIdentity(identity)
+		if err != nil {
+			cache.Close()
+			return nil, err
+		}
+	}
+
+	return cache, nil
+}
@@ -0,0 +1,61 @@
+package singleply
+
+import "sync"
+
+// fetch is a download of a region of a file which is in progress.  Readers who need bytes in that
+// region wait for it to finish instead of downloading the same bytes again.
+type fetch struct {
+	region Region
+	group  *jobGroup
+	done   chan bool
+	err    error
+}
+
+type inflightFetches struct {
+	lock    sync.Mutex
+	fetches map[string][]*fetch
+}
+
+func newInflightFetches() *inflightFetches {
+	return &inflightFetches{fetches: make(map[string][]*fetch)}
+}
+
+// claim registers a fetch of region of path.  If a fetch which overlaps region is already in
+// progress, nothing is registered and that fetch is returned as other so the caller can wait on it.
+func (f *inflightFetches) claim(path string, region Region, priority Priority) (mine *fetch, other *fetch) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, existing := range f.fetches[path] {
+		if existing.region.Offset < region.end() && region.Offset < existing.region.end() {
+			return nil, existing
+		}
+	}
+
+	mine = &fetch{region: region, group: &jobGroup{priority: priority}, done: make(chan bool)}
+	f.fetches[path] = append(f.fetches[path], mine)
+	return mine, nil
+}
+
+// complete unregisters a fetch returned from claim, and wakes up everyone waiting on it.  err is
+// passed along to each of them.
+func (f *inflightFetches) complete(path string, mine *fetch, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	fetches := f.fetches[path]
+	for i, existing := range fetches {
+		if existing == mine {
+			fetches = append(fetches[:i], fetches[i+1:]...)
+			break
+		}
+	}
+	if len(fetches) == 0 {
+		delete(f.fetches, path)
+	} else {
+		f.fetches[path] = fetches
+	}
+
+	mine.err = err
+	close(mine.done)
+}
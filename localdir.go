@@ -0,0 +1,141 @@
+package singleply
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// LocalDirConnector serves a directory tree on the local filesystem (or anything mounted there, such
+// as NFS) through the Connector interface.  Etags are derived from the size and modification time of
+// each file, or from an MD5 of its contents if hashEtags is set.
+type LocalDirConnector struct {
+	root      string
+	hashEtags bool
+
+	lock   sync.Mutex
+	hashes map[string]*cachedHash
+}
+
+// cachedHash remembers the hash of a file so it only gets recomputed when the file changes
+type cachedHash struct {
+	size    int64
+	modTime int64
+	hash    string
+}
+
+func NewLocalDirConnector(root string, hashEtags bool) *LocalDirConnector {
+	return &LocalDirConnector{root: root, hashEtags: hashEtags, hashes: make(map[string]*cachedHash)}
+}
+
+func (c *LocalDirConnector) fullPath(path string) string {
+	// cleaning relative to "/" first keeps ".." from escaping the root
+	return filepath.Join(c.root, filepath.Clean("/"+path))
+}
+
+func (c *LocalDirConnector) etag(fullPath string, info os.FileInfo) (string, error) {
+	if !c.hashEtags {
+		return fmt.Sprintf("%x-%x", info.Size(), info.ModTime().UnixNano()), nil
+	}
+
+	c.lock.Lock()
+	cached := c.hashes[fullPath]
+	c.lock.Unlock()
+	if cached != nil && cached.size == info.Size() && cached.modTime == info.ModTime().UnixNano() {
+		return cached.hash, nil
+	}
+
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	c.lock.Lock()
+	c.hashes[fullPath] = &cachedHash{size: info.Size(), modTime: info.ModTime().UnixNano(), hash: hash}
+	c.lock.Unlock()
+
+	return hash, nil
+}
+
+func (c *LocalDirConnector) ListDir(ctx context.Context, path string, status StatusCallback) (*DirEntries, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	dir := c.fullPath(path)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, classifyLocalError(path, err)
+	}
+
+	files := make([]*FileStat, 0, len(infos))
+	for _, info := range infos {
+		if info.Mode()&os.ModeSymlink != 0 {
+			// follow symlinks, skipping any which are dangling
+			info, err = os.Stat(filepath.Join(dir, info.Name()))
+			if err != nil {
+				continue
+			}
+		}
+
+		if info.IsDir() {
+			files = append(files, &FileStat{Name: info.Name(), IsDir: true, Size: uint64(0)})
+		} else if info.Mode().IsRegular() {
+			etag, err := c.etag(filepath.Join(dir, info.Name()), info)
+			if err != nil {
+				return nil, classifyLocalError(path, err)
+			}
+			stat := &FileStat{Name: info.Name(), IsDir: false, Size: uint64(info.Size()), Etag: etag}
+			if c.hashEtags {
+				stat.Checksum = "md5:" + etag
+			}
+			files = append(files, stat)
+		}
+	}
+
+	return &DirEntries{Files: files}, nil
+}
+
+func (c *LocalDirConnector) PrepareForRead(ctx context.Context, path string, etag string, localPath string, offset uint64, length uint64, status StatusCallback) (prepared *Region, err error) {
+	fullPath := c.fullPath(path)
+	src, err := os.Open(fullPath)
+	if err != nil {
+		return nil, classifyLocalError(path, err)
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return nil, classifyLocalError(path, err)
+	}
+
+	currentEtag, err := c.etag(fullPath, info)
+	if err != nil {
+		return nil, classifyLocalError(path, err)
+	}
+	if currentEtag != etag {
+		return nil, UpdateDetected
+	}
+
+	written, err := copyTo(ctx, localPath, offset, length, ioutil.NopCloser(io.NewSectionReader(src, int64(offset), int64(length))))
+	if err != nil {
+		return &Region{offset, written}, err
+	}
+
+	return &Region{offset, length}, nil
+}
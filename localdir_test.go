@@ -0,0 +1,105 @@
+package singleply
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	. "gopkg.in/check.v1"
+)
+
+type LocalDirSuite struct{}
+
+var _ = Suite(&LocalDirSuite{})
+
+func (s *LocalDirSuite) TestListDirAndRead(c *C) {
+	for _, hashEtags := range []bool{false, true} {
+		root := c.MkDir()
+		c.Assert(os.Mkdir(root+"/sampledir", 0700), IsNil)
+		c.Assert(ioutil.WriteFile(root+"/sampledir/a", []byte("0123456789"), 0600), IsNil)
+		c.Assert(ioutil.WriteFile(root+"/banana", make([]byte, 100), 0600), IsNil)
+
+		conn := NewLocalDirConnector(root, hashEtags)
+		files, err := conn.ListDir(context.Background(), "", nil)
+		c.Assert(err, IsNil)
+		c.Assert(len(files.Files), Equals, 2)
+		c.Assert(files.Get("sampledir").IsDir, Equals, true)
+		c.Assert(files.Get("banana").Size, Equals, uint64(100))
+
+		files, err = conn.ListDir(context.Background(), "sampledir", nil)
+		c.Assert(err, IsNil)
+		f := files.Get("a")
+		c.Assert(f.Size, Equals, uint64(10))
+		c.Assert(f.Etag, Not(Equals), "")
+
+		localPath := c.MkDir() + "/dest"
+		c.Assert(ioutil.WriteFile(localPath, []byte{}, 0600), IsNil)
+
+		region, err := conn.PrepareForRead(context.Background(), "sampledir/a", f.Etag, localPath, 3, 4, nil)
+		c.Assert(err, IsNil)
+		c.Assert(*region, Equals, Region{3, 4})
+		data, err := ioutil.ReadFile(localPath)
+		c.Assert(err, IsNil)
+		c.Assert(string(data[3:]), Equals, "3456")
+
+		// paths cannot escape the root
+		_, err = conn.ListDir(context.Background(), "../..", nil)
+		c.Assert(err, IsNil)
+
+		// changing the file changes its etag
+		c.Assert(ioutil.WriteFile(root+"/sampledir/a", []byte("abcdefghij"), 0600), IsNil)
+		later := time.Now().Add(time.Minute)
+		c.Assert(os.Chtimes(root+"/sampledir/a", later, later), IsNil)
+		_, err = conn.PrepareForRead(context.Background(), "sampledir/a", f.Etag, localPath, 0, 4, nil)
+		c.Assert(err, Equals, UpdateDetected)
+	}
+}
+
+func (s *LocalDirSuite) TestReadThroughFS(c *C) {
+	root := c.MkDir()
+	content := make([]byte, 1000)
+	for i := range content {
+		content[i] = contentAt(uint64(i))
+	}
+	c.Assert(ioutil.WriteFile(root+"/data", content, 0600), IsNil)
+
+	fs, cache := newTestFS(c, NewLocalDirConnector(root, false), &FSOptions{BlockSize: 64, MaxGap: 64, ParallelParts: 3, MinPartSize: 64})
+	defer cache.Close()
+
+	files, err := fs.ListDir(context.Background(), "")
+	c.Assert(err, IsNil)
+	f := files.Get("data")
+
+	localPath, err := cache.GetLocalFile("data", f.Etag, f.Size)
+	c.Assert(err, IsNil)
+
+	err = fs.PrepareForRead(context.Background(), "data", f.Etag, localPath, f.Size, 100, 500, PriorityRead, nil)
+	c.Assert(err, IsNil)
+	err = fs.PrepareForRead(context.Background(), "data", f.Etag, localPath, f.Size, 900, 200, PriorityRead, nil)
+	c.Assert(err, IsNil)
+
+	data, err := ioutil.ReadFile(localPath)
+	c.Assert(err, IsNil)
+	c.Assert(data[64:640], DeepEquals, content[64:640])
+	c.Assert(data[896:], DeepEquals, content[896:])
+
+	missing, err := cache.GetMissingRegions("data", f.Etag, 0, f.Size)
+	c.Assert(err, IsNil)
+	c.Assert(missing, DeepEquals, []Region{{0, 64}, {640, 256}})
+}
+
+func (s *LocalDirSuite) TestMissingPaths(c *C) {
+	conn := NewLocalDirConnector(c.MkDir(), false)
+
+	_, err := conn.ListDir(context.Background(), "nodir", nil)
+	c.Assert(err, FitsTypeOf, &BackendError{})
+	c.Assert(err.(*BackendError).Kind, Equals, BackendNotFound)
+	c.Assert(errnoOf(err), Equals, fuse.ENOENT)
+
+	localPath := c.MkDir() + "/dest"
+	c.Assert(ioutil.WriteFile(localPath, []byte{}, 0600), IsNil)
+	_, err = conn.PrepareForRead(context.Background(), "nofile", "1", localPath, 0, 4, nil)
+	c.Assert(errnoOf(err), Equals, fuse.ENOENT)
+}
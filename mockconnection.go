@@ -4,13 +4,19 @@ import (
 	"bytes"
 	"io"
 	"os"
+
+	"golang.org/x/net/context"
 )
 
 // just used for testing.  A connector which claims every dir has the same contents.  And every file contains just its own filename
 type MockConn struct {
 }
 
-func (c *MockConn) PrepareForRead(path string, etag string, localPath string, offset uint64, length uint64, status StatusCallback) (prepared *Region, err error) {
+func (c *MockConn) PrepareForRead(ctx context.Context, path string, etag string, localPath string, offset uint64, length uint64, status StatusCallback) (prepared *Region, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	f, err := os.OpenFile(localPath, os.O_RDWR, 0)
 
 	if err != nil {
@@ -26,7 +32,10 @@ func (c *MockConn) PrepareForRead(path string, etag string, localPath string, of
 	return &Region{0, uint64(len(content))}, nil
 }
 
-func (c *MockConn) ListDir(path string, status StatusCallback) (*DirEntries, error) {
+func (c *MockConn) ListDir(ctx context.Context, path string, status StatusCallback) (*DirEntries, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	files := make([]*FileStat, 0, 100)
 	files = append(files, &FileStat{Name: "dir1", IsDir: true, Size: uint64(0)})
 	files = append(files, &FileStat{Name: "dir2", IsDir: true, Size: uint64(0)})
@@ -0,0 +1,54 @@
+package singleply
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// isNetworkError reports whether err means the backend could not be reached at all, as opposed to the
+// backend responding with an error
+func isNetworkError(err error) bool {
+	for err != nil {
+		if isCancellation(err) {
+			return false
+		}
+		switch e := err.(type) {
+		case *BackendError:
+			err = e.Err
+		case awserr.Error:
+			err = e.OrigErr()
+		case *url.Error:
+			err = e.Err
+		case net.Error:
+			return true
+		case *os.SyscallError:
+			err = e.Err
+		case syscall.Errno:
+			return e == syscall.ECONNREFUSED || e == syscall.ECONNRESET || e == syscall.ETIMEDOUT ||
+				e == syscall.ENETUNREACH || e == syscall.EHOSTUNREACH || e == syscall.ENETDOWN
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// setOffline records whether the backend is currently reachable
+func (fs *FS) setOffline(offline bool) {
+	if fs.stats.SetOffline(offline) {
+		if offline {
+			fmt.Printf("Backend is unreachable, serving from cache\n")
+		} else {
+			fmt.Printf("Backend is reachable again\n")
+		}
+	}
+}
+
+func (fs *FS) IsOffline() bool {
+	return fs.stats.IsOffline()
+}
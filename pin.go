@@ -0,0 +1,191 @@
+package singleply
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/net/context"
+)
+
+// PINS holds the paths of pinned files, and when they were pinned.  Pins belong to the path rather
+// than a version, so a file which is replaced stays pinned.  A pin on a whole tree is stored under the
+// directory's path with a trailing "/", and covers files added below it after it was pinned too.
+const PINS = "pins"
+
+// pinnedTreeKey is the key of the pin on everything below path.  The root's is "/".
+func pinnedTreeKey(path string) []byte {
+	return []byte(path + "/")
+}
+
+// isPinned reports whether path is pinned itself or lies below a pinned tree
+func isPinned(pins *bolt.Bucket, path string) bool {
+	if pins.Get([]byte(path)) != nil {
+		return true
+	}
+	for dir := path; dir != ""; {
+		dir = parentPath(dir)
+		if pins.Get(pinnedTreeKey(dir)) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// PinSummary describes the files affected by FS.Pin
+type PinSummary struct {
+	Files int
+	Bytes uint64
+}
+
+// Pin exempts path from eviction.  Pinning a path which has not been cached yet is allowed, so it can
+// be pinned before it is downloaded.
+func (c *LocalCache) Pin(path string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(PINS)).Put([]byte(path), []byte(time.Now().Format(time.RFC3339)))
+	})
+}
+
+// PinTree exempts every file below the directory at path from eviction, including files which are
+// added to it later
+func (c *LocalCache) PinTree(path string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(PINS)).Put(pinnedTreeKey(path), []byte(time.Now().Format(time.RFC3339)))
+	})
+}
+
+// Unpin makes path subject to eviction again, along with every pinned path below it if recursive is
+// set.  A pin on the tree below path is removed either way.  Returns the number of pins removed.
+func (c *LocalCache) Unpin(path string, recursive bool) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	removed := 0
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(PINS))
+
+		keys := make([][]byte, 0)
+		if b.Get([]byte(path)) != nil {
+			keys = append(keys, []byte(path))
+		}
+		if !recursive && b.Get(pinnedTreeKey(path)) != nil {
+			keys = append(keys, pinnedTreeKey(path))
+		}
+		if recursive {
+			prefix := ""
+			if path != "" {
+				prefix = path + "/"
+			}
+			err := b.ForEach(func(k, v []byte) error {
+				if strings.HasPrefix(string(k), prefix) && string(k) != path {
+					keys = append(keys, k)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, key := range keys {
+			err := b.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+		removed = len(keys)
+		return nil
+	})
+	return removed, err
+}
+
+// PinnedBytes returns the number of bytes of pinned files in the cache
+func (c *LocalCache) PinnedBytes() (uint64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var total uint64
+	err := c.db.View(func(tx *bolt.Tx) error {
+		pins := tx.Bucket([]byte(PINS))
+		return tx.Bucket([]byte(FILE_MAP)).ForEach(func(k, v []byte) error {
+			if !isPinned(pins, string(k)) {
+				return nil
+			}
+			e, err := decodeFileCacheEntry(v)
+			if err != nil {
+				return err
+			}
+			total += e.Valid.total()
+			return nil
+		})
+	})
+	return total, err
+}
+
+func (fs *FS) updatePinnedBytes() {
+	pinned, err := fs.cache.PinnedBytes()
+	if err != nil {
+		fmt.Printf("Could not count pinned bytes: %s\n", err.Error())
+		return
+	}
+	fs.stats.SetPinnedBytes(int64(pinned))
+}
+
+// Pin pins path, or the whole tree below it if it is a directory and recursive is set, and downloads
+// the files in full at prefetch priority.  Files added to a pinned tree later are pinned as well, but
+// are only downloaded when they are read or the tree is pinned again.  If a download fails, the files
+// stay pinned and pinning them again resumes from where it stopped.  Only the versions current at the
+// time are downloaded; a pinned file which is later replaced is downloaded again when it is next read.
+func (fs *FS) Pin(ctx context.Context, path string, recursive bool, status StatusCallback) (*PinSummary, error) {
+	summary := &PinSummary{}
+	defer fs.updatePinnedBytes()
+
+	root := strings.Trim(path, "/")
+	if recursive {
+		err := fs.cache.PinTree(root)
+		if err != nil {
+			return summary, err
+		}
+	}
+
+	err := fs.walkFiles(ctx, root, recursive, func(path string, stat *FileStat) error {
+		if path == root {
+			err := fs.cache.Pin(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		localPath, err := fs.cache.GetLocalFile(path, stat.Etag, stat.Size)
+		if err != nil {
+			return err
+		}
+		if status != nil {
+			status.SetStatus(fmt.Sprintf("pinning %s (%d files, %d bytes done)", path, summary.Files, summary.Bytes))
+		}
+		err = fs.PrepareForRead(ctx, path, stat.Etag, localPath, stat.Size, 0, stat.Size, PriorityPrefetch, nil)
+		if err != nil {
+			return err
+		}
+
+		summary.Files++
+		summary.Bytes += stat.Size
+		return nil
+	})
+	return summary, err
+}
+
+// Unpin removes the pin from path, and from every path below it if recursive is set.  The files are
+// left in the cache until they are evicted.
+func (fs *FS) Unpin(path string, recursive bool) (int, error) {
+	removed, err := fs.cache.Unpin(strings.Trim(path, "/"), recursive)
+	fs.updatePinnedBytes()
+	return removed, err
+}
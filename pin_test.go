@@ -0,0 +1,119 @@
+package singleply
+
+import (
+	"golang.org/x/net/context"
+	. "gopkg.in/check.v1"
+)
+
+type PinSuite struct{}
+
+var _ = Suite(&PinSuite{})
+
+// treeConn serves files in nested directories, with contents as for recordingConn
+type treeConn struct {
+	*recordingConn
+	dirs map[string][]*FileStat
+}
+
+func newTreeConn() *treeConn {
+	return &treeConn{recordingConn: newRecordingConn(), dirs: map[string][]*FileStat{
+		"":    {{Name: "d", IsDir: true}, {Name: "top", Size: 10, Etag: "1"}},
+		"d":   {{Name: "a", Size: 300, Etag: "1"}, {Name: "e", IsDir: true}},
+		"d/e": {{Name: "b", Size: 50, Etag: "1"}},
+	}}
+}
+
+func (c *treeConn) ListDir(ctx context.Context, path string, status StatusCallback) (*DirEntries, error) {
+	return &DirEntries{Files: c.dirs[path]}, nil
+}
+
+func (s *PinSuite) TestPinnedFilesAreNotEvicted(c *C) {
+	dir := c.MkDir()
+	cache, err := NewLocalCache(dir)
+	c.Assert(err, IsNil)
+
+	for _, path := range []string{"x/a", "x/b", "y"} {
+		_, err := cache.GetLocalFile(path, "1", 100)
+		c.Assert(err, IsNil)
+		cache.AddedRegions(path, "1", 0, 100)
+	}
+	c.Assert(cache.Pin("x/a"), IsNil)
+	c.Assert(cache.Pin("x/b"), IsNil)
+	cache.Close()
+
+	// pins survive a restart
+	cache, err = NewLocalCache(dir)
+	c.Assert(err, IsNil)
+	defer cache.Close()
+	cache.policy = EvictionPolicy{MaxSize: 1}
+
+	pinned, err := cache.PinnedBytes()
+	c.Assert(err, IsNil)
+	c.Assert(pinned, Equals, uint64(200))
+
+	c.Assert(cache.evict(), IsNil)
+	c.Assert(cache.EvictFile("y", ""), Equals, NotInCache)
+	_, err = cache.GetMissingRegions("x/a", "1", 0, 100)
+	c.Assert(err, IsNil)
+
+	removed, err := cache.Unpin("x", true)
+	c.Assert(err, IsNil)
+	c.Assert(removed, Equals, 2)
+
+	c.Assert(cache.evict(), IsNil)
+	_, err = cache.GetMissingRegions("x/a", "1", 0, 100)
+	c.Assert(err, Equals, NotInCache)
+	pinned, err = cache.PinnedBytes()
+	c.Assert(err, IsNil)
+	c.Assert(pinned, Equals, uint64(0))
+}
+
+func (s *PinSuite) TestPinDownloadsFiles(c *C) {
+	conn := newTreeConn()
+	fs, cache := newTestFS(c, conn, &FSOptions{BlockSize: 100})
+	defer cache.Close()
+
+	_, err := fs.Pin(context.Background(), "d", false, nil)
+	c.Assert(err, NotNil)
+	_, err = fs.Pin(context.Background(), "d/missing", false, nil)
+	c.Assert(errnoOf(err), Equals, errnoOf(&BackendError{Kind: BackendNotFound}))
+
+	summary, err := fs.Pin(context.Background(), "/d/", true, nil)
+	c.Assert(err, IsNil)
+	c.Assert(*summary, Equals, PinSummary{Files: 2, Bytes: 350})
+	c.Assert(fs.stats.PinnedBytes, Equals, int64(350))
+
+	for path, size := range map[string]uint64{"d/a": 300, "d/e/b": 50} {
+		missing, err := cache.GetMissingRegions(path, "1", 0, size)
+		c.Assert(err, IsNil)
+		c.Assert(missing, DeepEquals, []Region{})
+	}
+	_, err = cache.GetMissingRegions("top", "1", 0, 10)
+	c.Assert(err, Equals, NotInCache)
+
+	// files added to the tree later are pinned too
+	_, err = cache.GetLocalFile("d/e/c", "1", 100)
+	c.Assert(err, IsNil)
+	c.Assert(cache.AddedRegions("d/e/c", "1", 0, 100), IsNil)
+	files, err := cache.CachedFiles("d", true)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 3)
+	for _, file := range files {
+		c.Assert(file.Pinned, Equals, true)
+	}
+	cache.policy = EvictionPolicy{MaxSize: 1}
+	c.Assert(cache.evict(), IsNil)
+	_, err = cache.GetMissingRegions("d/e/c", "1", 0, 100)
+	c.Assert(err, IsNil)
+
+	// a file in a pinned tree stays pinned until the tree is unpinned
+	removed, err := fs.Unpin("d/e/b", false)
+	c.Assert(err, IsNil)
+	c.Assert(removed, Equals, 0)
+	c.Assert(fs.stats.PinnedBytes, Equals, int64(450))
+
+	removed, err = fs.Unpin("d", true)
+	c.Assert(err, IsNil)
+	c.Assert(removed, Equals, 1)
+	c.Assert(fs.stats.PinnedBytes, Equals, int64(0))
+}
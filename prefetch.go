@@ -0,0 +1,174 @@
+package singleply
+
+import (
+	"fmt"
+	gopath "path"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+const DefaultPrefetchConcurrency = 4
+
+// PrefetchOptions selects the files FS.Prefetch downloads.  Include is a glob matched against the
+// name of each file, as for path.Match; an empty Include matches everything.
+type PrefetchOptions struct {
+	Recursive   bool
+	Include     string
+	DryRun      bool
+	Concurrency int
+}
+
+// PrefetchProgress counts the files which are not yet fully cached and the bytes missing from them,
+// and how many of those have been fetched so far
+type PrefetchProgress struct {
+	Files       int
+	Bytes       uint64
+	FilesDone   int
+	BytesDone   uint64
+	FilesFailed int
+	Done        bool
+	Error       string
+}
+
+func (p PrefetchProgress) String() string {
+	return fmt.Sprintf("fetched %d of %d files (%d of %d bytes), %d failed", p.FilesDone, p.Files, p.BytesDone, p.Bytes, p.FilesFailed)
+}
+
+type prefetchTarget struct {
+	path    string
+	stat    *FileStat
+	missing uint64
+}
+
+// Prefetch downloads the files at or below path which match options in full, at prefetch priority
+// and with at most options.Concurrency files in progress at once.  progress is called each time a
+// file completes, and once more when everything is done.  A file which fails doesn't stop the others
+// from being fetched; the last failure is returned.
+func (fs *FS) Prefetch(ctx context.Context, path string, options PrefetchOptions, progress func(PrefetchProgress)) error {
+	var lock sync.Mutex
+	var current PrefetchProgress
+	update := func(fn func(p *PrefetchProgress)) {
+		lock.Lock()
+		defer lock.Unlock()
+		fn(&current)
+		if progress != nil {
+			progress(current)
+		}
+	}
+
+	targets, err := fs.prefetchTargets(ctx, path, options)
+	if err != nil {
+		update(func(p *PrefetchProgress) {
+			p.Done = true
+			p.Error = err.Error()
+		})
+		return err
+	}
+	for _, target := range targets {
+		current.Files++
+		current.Bytes += target.missing
+	}
+
+	if options.DryRun {
+		update(func(p *PrefetchProgress) { p.Done = true })
+		return nil
+	}
+
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultPrefetchConcurrency
+	}
+
+	work := make(chan *prefetchTarget)
+	var lastErr error
+	var workers sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for target := range work {
+				err := fs.prefetchFile(ctx, target)
+				update(func(p *PrefetchProgress) {
+					if err != nil {
+						fmt.Printf("Prefetch of %s failed: %s\n", target.path, err.Error())
+						p.FilesFailed++
+						lastErr = err
+						return
+					}
+					p.FilesDone++
+					p.BytesDone += target.missing
+				})
+			}
+		}()
+	}
+
+	for _, target := range targets {
+		if ctx.Err() != nil {
+			break
+		}
+		work <- target
+	}
+	close(work)
+	workers.Wait()
+
+	if lastErr == nil && ctx.Err() != nil {
+		lastErr = ctx.Err()
+	}
+	update(func(p *PrefetchProgress) {
+		p.Done = true
+		if lastErr != nil {
+			p.Error = lastErr.Error()
+		}
+	})
+	return lastErr
+}
+
+// prefetchTargets finds the files which match options and are missing from the cache
+func (fs *FS) prefetchTargets(ctx context.Context, path string, options PrefetchOptions) ([]*prefetchTarget, error) {
+	if options.Include != "" {
+		if _, err := gopath.Match(options.Include, ""); err != nil {
+			return nil, fmt.Errorf("Invalid include pattern \"%s\": %s", options.Include, err)
+		}
+	}
+
+	targets := make([]*prefetchTarget, 0)
+	err := fs.walkFiles(ctx, path, options.Recursive, func(path string, stat *FileStat) error {
+		if options.Include != "" {
+			if matched, _ := gopath.Match(options.Include, stat.Name); !matched {
+				return nil
+			}
+		}
+
+		var missing uint64
+		// a dry run mustn't make the files it looks at seem recently read
+		regions, err := fs.cache.PeekMissingRegions(path, stat.Etag, 0, stat.Size)
+		if err == NotInCache {
+			missing = stat.Size
+		} else if err != nil {
+			return err
+		} else {
+			for _, region := range regions {
+				missing += region.Length
+			}
+		}
+
+		if missing > 0 {
+			targets = append(targets, &prefetchTarget{path: path, stat: stat, missing: missing})
+		}
+		return nil
+	})
+	return targets, err
+}
+
+func (fs *FS) prefetchFile(ctx context.Context, target *prefetchTarget) error {
+	// held open like a FileHandle, so the file isn't evicted while it is being fetched
+	fs.cache.FileOpened(target.path)
+	defer fs.cache.FileClosed(target.path)
+
+	localPath, err := fs.cache.GetLocalFile(target.path, target.stat.Etag, target.stat.Size)
+	if err != nil {
+		return err
+	}
+	return fs.PrepareForRead(ctx, target.path, target.stat.Etag, localPath, target.stat.Size, 0, target.stat.Size, PriorityPrefetch, nil)
+}
@@ -0,0 +1,100 @@
+package singleply
+
+import (
+	"golang.org/x/net/context"
+	. "gopkg.in/check.v1"
+)
+
+type PrefetchSuite struct{}
+
+var _ = Suite(&PrefetchSuite{})
+
+func (s *PrefetchSuite) TestDryRun(c *C) {
+	conn := newTreeConn()
+	fs, cache := newTestFS(c, conn, &FSOptions{BlockSize: 100})
+	defer cache.Close()
+
+	// bytes which are already cached are not counted
+	localPath, err := cache.GetLocalFile("d/a", "1", 300)
+	c.Assert(err, IsNil)
+	c.Assert(fs.PrepareForRead(context.Background(), "d/a", "1", localPath, 300, 0, 100, PriorityRead, nil), IsNil)
+	conn.takeRequests()
+	accessed, wasAccessed := cache.accessed["d/a"]
+
+	var last PrefetchProgress
+	err = fs.Prefetch(context.Background(), "", PrefetchOptions{Recursive: true, DryRun: true}, func(p PrefetchProgress) { last = p })
+	c.Assert(err, IsNil)
+	c.Assert(last, Equals, PrefetchProgress{Files: 3, Bytes: 260, Done: true})
+	c.Assert(conn.takeRequests(), HasLen, 0)
+
+	// looking doesn't count as reading, so the order files are evicted in is unchanged
+	stillAccessed, isAccessed := cache.accessed["d/a"]
+	c.Assert(isAccessed, Equals, wasAccessed)
+	c.Assert(stillAccessed, Equals, accessed)
+
+	err = fs.Prefetch(context.Background(), "", PrefetchOptions{Recursive: true, Include: "[ab]", DryRun: true}, func(p PrefetchProgress) { last = p })
+	c.Assert(err, IsNil)
+	c.Assert(last, Equals, PrefetchProgress{Files: 2, Bytes: 250, Done: true})
+
+	err = fs.Prefetch(context.Background(), "", PrefetchOptions{Include: "[", DryRun: true}, nil)
+	c.Assert(err, NotNil)
+}
+
+func (s *PrefetchSuite) TestPrefetch(c *C) {
+	conn := newTreeConn()
+	fs, cache := newTestFS(c, conn, &FSOptions{BlockSize: 100})
+	defer cache.Close()
+
+	updates := 0
+	var last PrefetchProgress
+	err := fs.Prefetch(context.Background(), "d", PrefetchOptions{Recursive: true, Concurrency: 2}, func(p PrefetchProgress) {
+		updates++
+		last = p
+	})
+	c.Assert(err, IsNil)
+	c.Assert(last, Equals, PrefetchProgress{Files: 2, Bytes: 350, FilesDone: 2, BytesDone: 350, Done: true})
+	c.Assert(updates, Equals, 3)
+
+	for path, size := range map[string]uint64{"d/a": 300, "d/e/b": 50} {
+		missing, err := cache.GetMissingRegions(path, "1", 0, size)
+		c.Assert(err, IsNil)
+		c.Assert(missing, DeepEquals, []Region{})
+	}
+	_, err = cache.GetMissingRegions("top", "1", 0, 10)
+	c.Assert(err, Equals, NotInCache)
+
+	// nothing is left to fetch
+	conn.takeRequests()
+	err = fs.Prefetch(context.Background(), "d", PrefetchOptions{Recursive: true}, func(p PrefetchProgress) { last = p })
+	c.Assert(err, IsNil)
+	c.Assert(last, Equals, PrefetchProgress{Done: true})
+	c.Assert(conn.takeRequests(), HasLen, 0)
+}
+
+// openCheckingConn records the files which are fetched while the cache doesn't hold them open
+type openCheckingConn struct {
+	*treeConn
+	cache  *LocalCache
+	closed []string
+}
+
+func (c *openCheckingConn) PrepareForRead(ctx context.Context, path string, etag string, localPath string, offset uint64, length uint64, status StatusCallback) (*Region, error) {
+	c.cache.lock.Lock()
+	if c.cache.open[path] == 0 {
+		c.closed = append(c.closed, path)
+	}
+	c.cache.lock.Unlock()
+	return c.treeConn.PrepareForRead(ctx, path, etag, localPath, offset, length, status)
+}
+
+func (s *PrefetchSuite) TestPrefetchHoldsFilesOpen(c *C) {
+	conn := &openCheckingConn{treeConn: newTreeConn()}
+	fs, cache := newTestFS(c, conn, &FSOptions{BlockSize: 100})
+	defer cache.Close()
+	conn.cache = cache
+
+	err := fs.Prefetch(context.Background(), "", PrefetchOptions{Recursive: true}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(conn.closed, HasLen, 0)
+	c.Assert(cache.open, HasLen, 0)
+}
@@ -2,7 +2,9 @@ package singleply
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"sync"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
@@ -15,11 +17,17 @@ type FileStat struct {
 	Size  uint64
 	Name  string
 	Etag  string
+
+	// Checksum is the checksum of the whole object, if the backend provides one.  See BlockChecksums.
+	Checksum string
 }
 
+// Connector is the interface to a storage backend.  Calls should give up promptly once ctx is done.
+// If PrepareForRead fails part way through, prepared covers the bytes starting at offset which were
+// written before the failure, so they don't have to be downloaded again.
 type Connector interface {
-	ListDir(path string, status StatusCallback) (*DirEntries, error)
-	PrepareForRead(path string, etag string, localPath string, offset uint64, length uint64, status StatusCallback) (prepared *Region, err error)
+	ListDir(ctx context.Context, path string, status StatusCallback) (*DirEntries, error)
+	PrepareForRead(ctx context.Context, path string, etag string, localPath string, offset uint64, length uint64, status StatusCallback) (prepared *Region, err error)
 }
 
 type Region struct {
@@ -32,10 +40,86 @@ type FS struct {
 	cache     Cache
 	tracker   *Tracker
 	stats *Stats
+	options   *FSOptions
+	inflight  *inflightFetches
+	scheduler *Scheduler
+
+	// the latest etag of each file which has changed while open, or "" if it was deleted, and the
+	// number of handles open on each file.  Changes are forgotten once the last handle is released.
+	updateLock sync.Mutex
+	updated    map[string]string
+	handles    map[string]int
+
+	// the etag of each file whose content kept failing verification, also guarded by updateLock
+	checksumFailures map[string]string
+}
+
+// FSOptions tunes how FS fetches data through the Connector
+type FSOptions struct {
+	// MaxGap is the largest run of already cached bytes which will be downloaded again in order to
+	// fetch the missing regions on either side of it with a single request
+	MaxGap uint64
+
+	// BlockSize is the granularity of fetches.  Missing regions are rounded out to whole blocks, so
+	// the regions recorded in the cache cover whole blocks, except at the end of the file or where a
+	// fetch was interrupted.  Zero fetches exactly the bytes requested.
+	BlockSize uint64
+
+	// Once a FileHandle is being read sequentially, data is fetched ahead of the reader in the
+	// background.  The window starts at MinReadahead and doubles up to MaxReadahead.  A MaxReadahead
+	// of zero disables readahead.
+	MinReadahead uint64
+	MaxReadahead uint64
+
+	// Regions larger than MinPartSize are split into up to ParallelParts parts which are downloaded
+	// concurrently.  No part is smaller than MinPartSize.
+	ParallelParts int
+	MinPartSize   uint64
+
+	// MaxConcurrentRequests bounds the number of calls to the Connector which can be in progress at once
+	MaxConcurrentRequests int
+
+	// UpdatePolicy decides what happens to open files whose object changes while they are read
+	UpdatePolicy UpdatePolicy
+
+	// VerifyChecksums checks complete files against the checksum reported by the backend, and blocks
+	// of the local files against checksums taken when they were downloaded.  Copies which fail are
+	// evicted and downloaded again.
+	VerifyChecksums bool
 }
 
-func NewFileSystem(connector Connector, cache Cache, tracker *Tracker, stats *Stats) *FS {
-	return &FS{connector: connector, cache: cache, tracker: tracker, stats: stats}
+const DefaultMaxGap = 256 * 1024
+const DefaultBlockSize = 8 * 1024 * 1024
+const DefaultMinReadahead = DefaultBlockSize
+const DefaultMaxReadahead = 64 * 1024 * 1024
+const DefaultParallelParts = 4
+const DefaultMinPartSize = 8 * 1024 * 1024
+const DefaultMaxConcurrentRequests = 16
+
+func DefaultFSOptions() *FSOptions {
+	return &FSOptions{MaxGap: DefaultMaxGap,
+		BlockSize:     DefaultBlockSize,
+		MinReadahead:  DefaultMinReadahead,
+		MaxReadahead:  DefaultMaxReadahead,
+		ParallelParts: DefaultParallelParts,
+		MinPartSize:   DefaultMinPartSize,
+		MaxConcurrentRequests: DefaultMaxConcurrentRequests}
+}
+
+func NewFileSystem(connector Connector, cache Cache, tracker *Tracker, stats *Stats, options *FSOptions) *FS {
+	if options == nil {
+		options = DefaultFSOptions()
+	}
+	return &FS{connector: connector,
+		cache:     cache,
+		tracker:   tracker,
+		stats:     stats,
+		options:   options,
+		inflight:  newInflightFetches(),
+		scheduler: NewScheduler(options.MaxConcurrentRequests, stats),
+		updated:   make(map[string]string),
+		handles:   make(map[string]int),
+		checksumFailures: make(map[string]string)}
 }
 
 func (f *FS) Root() (fs.Node, error) {
@@ -52,7 +136,11 @@ func (fs *FS) cleanupOldSnapshot(path string, oldFiles *DirEntries, newFiles *Di
 		// for each file, if it no longer exists or has changed, evict it from the cache
 		currentEtag, present := current[file.Name]
 		if !present || currentEtag != file.Etag {
- 			err := fs.cache.EvictFile(path + "/" + file.Name)
+			childPath := file.Name
+			if path != "" {
+				childPath = path + "/" + file.Name
+			}
+ 			err := fs.cache.EvictFile(childPath, file.Etag)
 			
 			if err == nil {
 				fs.stats.IncFilesEvicted()
@@ -65,7 +153,7 @@ func (fs *FS) cleanupOldSnapshot(path string, oldFiles *DirEntries, newFiles *Di
 	return nil
 }
 
-func (fs *FS) ListDir(path string) (*DirEntries, error) {
+func (fs *FS) ListDir(ctx context.Context, path string) (*DirEntries, error) {
 	cachedDir, err := fs.cache.GetListDir(path)
 	if err != nil {
 		fmt.Printf("cache.GetListDir returned error: %s\n", err.Error())
@@ -84,14 +172,27 @@ func (fs *FS) ListDir(path string) (*DirEntries, error) {
 	fmt.Printf("did not find dir \"%s\" in cache\n", path)
 	
 	state := fs.tracker.AddOperation(fmt.Sprintf("ListDir(%s)", path))
-	files, err := fs.connector.ListDir(path, state)
+	var files *DirEntries
+	runErr := fs.scheduler.Run(ctx, &jobGroup{priority: PriorityRead}, state, func() {
+		files, err = fs.connector.ListDir(ctx, path, state)
+	})
 	fs.tracker.OperationComplete(state)
+	if runErr != nil {
+		err = runErr
+	}
 
 	if err != nil {
 		fmt.Printf("ListDir returned error: %s\n", err.Error())
 		fs.stats.IncListDirFailedCount()
+		if cachedDir != nil && isNetworkError(err) {
+			// the backend is unreachable, so the stale listing is better than nothing
+			fs.setOffline(true)
+			fs.stats.IncOfflineFallbackCount()
+			return cachedDir, nil
+		}
 		return nil, err
 	}
+	fs.setOffline(false)
 	
 	fmt.Printf("calling IncListDirSuccessCount ------\n")
 	fs.stats.IncListDirSuccessCount()
@@ -111,44 +212,236 @@ func (fs *FS) ListDir(path string) (*DirEntries, error) {
 	if err != nil {
 		return nil, err
 	}
+	fs.listed(path, files)
 
 	return files, nil
 }
 
-func (fs *FS) PrepareForRead(path string, etag, localPath string, offset uint64, length uint64, status StatusCallback) error {
+// PrepareForRead makes sure the bytes from offset to offset+length of the file are in the local file.
+// size is the size of the whole file, and reads past the end are clamped to it.  If another caller is
+// already fetching some of the same bytes, this waits for that fetch rather than starting another.
+// priority determines the order in which the scheduler sends requests to the Connector.  If ctx is
+// done before the read completes, the fetch is abandoned and whatever was downloaded so far is kept.
+//
+// If the backend cannot be reached, the read still succeeds as long as the bytes requested ended up
+// in the cache, for instance from parts of the fetch which completed.  Otherwise it fails with EIO.
+func (fs *FS) PrepareForRead(ctx context.Context, path string, etag, localPath string, size uint64, offset uint64, length uint64, priority Priority, status StatusCallback) error {
+	if offset >= size {
+		return nil
+	}
+	length = min(length, size-offset)
+
+	err := fs.prepareForRead(ctx, path, etag, localPath, size, offset, length, priority, status)
+	if err != nil && isNetworkError(err) {
+		fs.setOffline(true)
+		missing, cacheErr := fs.cache.GetMissingRegions(path, etag, offset, length)
+		if cacheErr == nil && len(missing) == 0 {
+			fs.stats.IncOfflineFallbackCount()
+			return nil
+		}
+		fmt.Printf("Backend unreachable and %s is missing %d regions of (offset: %d, len: %d): %s\n", path, len(missing), offset, length, err.Error())
+		return fuse.EIO
+	}
+
+	return err
+}
+
+func (fs *FS) prepareForRead(ctx context.Context, path string, etag, localPath string, size uint64, offset uint64, length uint64, priority Priority, status StatusCallback) error {
 	for {
-		region := fs.cache.GetFirstMissingRegion(path, offset, length)
-		if region == nil {
-			break
+		regions, err := fs.regionsToFetch(path, etag, size, offset, length)
+		if err != nil {
+			return err
+		}
+
+		var total, fetched uint64
+		for _, region := range regions {
+			total += region.Length
+		}
+
+		waited := false
+		for _, region := range regions {
+			mine, other := fs.inflight.claim(path, region, priority)
+			if other != nil {
+				fs.stats.IncWaitedOnFetchCount()
+				fs.scheduler.promote(other.group, priority)
+				select {
+				case <-other.done:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				// if the reader who started that fetch gave up, fetch what is still missing ourselves
+				if other.err != nil && !isCancellation(other.err) {
+					return other.err
+				}
+				waited = true
+				continue
+			}
+
+			err = fs.fetchRegion(ctx, path, etag, localPath, size, region, mine.group, offset, length)
+			fs.inflight.complete(path, mine, err)
+			if err != nil {
+				return err
+			}
+
+			fetched += region.Length
+			if status != nil {
+				status.SetStatus(fmt.Sprintf("fetched %d of %d bytes", fetched, total))
+			}
+		}
+
+		// a fetch we waited on may not have covered everything we needed, so check again
+		if !waited {
+			return nil
+		}
+	}
+}
+
+// regionsToFetch returns the regions which need to be downloaded to satisfy a read, after rounding
+// out to whole blocks and merging regions separated by small gaps
+func (fs *FS) regionsToFetch(path string, etag string, size uint64, offset uint64, length uint64) ([]Region, error) {
+	missing, err := fs.cache.GetMissingRegions(path, etag, offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	if fs.options.BlockSize > 0 && len(missing) > 0 {
+		// fetch every block which is missing any bytes, in full.  Blocks between the first and last
+		// which are already complete are skipped.
+		first := alignRegion(missing[0], fs.options.BlockSize, size)
+		last := alignRegion(missing[len(missing)-1], fs.options.BlockSize, size)
+		missing, err = fs.cache.GetMissingRegions(path, etag, first.Offset, last.end()-first.Offset)
+		if err != nil {
+			return nil, err
 		}
+		missing = alignRegions(missing, fs.options.BlockSize, size)
+	}
 
-		fmt.Printf("Fetching region %s to fulfill read of (offset: %d, len: %s) for %s\n", region, offset, length, path)
-		state := fs.tracker.AddOperation(fmt.Sprintf("PrepareForRead(%s, %d, %d)", path, region.Offset, region.Length))
-		prepared, err := fs.connector.PrepareForRead(path, etag, localPath, region.Offset, region.Length, state)
-		fs.tracker.OperationComplete(state)
+	return coalesceRegions(missing, fs.options.MaxGap), nil
+}
+
+// fetchRegion downloads region of the file.  Large regions are split into parts which are downloaded
+// concurrently, and each part is recorded in the cache as soon as it completes, so if some parts fail
+// the ones which succeeded are kept.
+func (fs *FS) fetchRegion(ctx context.Context, path string, etag, localPath string, size uint64, region Region, group *jobGroup, offset uint64, length uint64) error {
+	fmt.Printf("Fetching region %v to fulfill read of (offset: %d, len: %d) for %s\n", region, offset, length, path)
+
+	parts := splitRegion(region, fs.options.ParallelParts, fs.options.MinPartSize, fs.options.BlockSize)
+	if len(parts) == 1 {
+		return fs.fetchPart(ctx, path, etag, localPath, size, region, group)
+	}
+
+	errs := make(chan error, len(parts))
+	for _, part := range parts {
+		go func(part Region) {
+			errs <- fs.fetchPart(ctx, path, etag, localPath, size, part, group)
+		}(part)
+	}
+
+	var firstErr error
+	for range parts {
+		err := <-errs
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+func (fs *FS) fetchPart(ctx context.Context, path string, etag, localPath string, size uint64, region Region, group *jobGroup) error {
+	var prepared *Region
+	var err error
+	if throttler, ok := fs.connector.(Throttler); ok {
+		// wait out the rate limit before taking a scheduler slot, so waiting doesn't hold one
+		ctx, err = throttler.Throttle(ctx, region.Length)
 		if err != nil {
-			fs.stats.IncPrepareForReadFailedCount()
 			return err
 		}
+	}
 
-		fs.stats.IncPrepareForReadSuccessCount()
-		fs.stats.IncBytesRead(int64(prepared.Length))
-		
-		if prepared.Offset > region.Offset || (prepared.Offset + prepared.Length) < (region.Offset + region.Length) {
-			return errors.New(fmt.Sprintf("Requested region %s but got %s", region, prepared))
+	state := fs.tracker.AddOperation(fmt.Sprintf("PrepareForRead(%s, %d, %d)", path, region.Offset, region.Length))
+	runErr := fs.scheduler.Run(ctx, group, state, func() {
+		prepared, err = fs.connector.PrepareForRead(ctx, path, etag, localPath, region.Offset, region.Length, state)
+	})
+	fs.tracker.OperationComplete(state)
+	if runErr != nil {
+		return runErr
+	}
+	if err != nil {
+		fs.stats.IncPrepareForReadFailedCount()
+		if prepared != nil && prepared.Length > 0 && prepared.Offset >= region.Offset && prepared.end() <= region.end() {
+			// keep the bytes which made it to disk before the failure
+			fmt.Printf("Keeping %v of %v for %s after failure: %s\n", *prepared, region, path, err.Error())
+			fs.stats.IncBytesRead(int64(prepared.Length))
+			if addErr := fs.addedRegion(path, etag, localPath, size, *prepared); addErr != nil {
+				fmt.Printf("Could not record %v of %s: %s\n", *prepared, path, addErr.Error())
+			}
 		}
-		
-		fs.cache.AddedRegions(path, prepared.Offset, prepared.Length)
+		return err
 	}
+	fs.setOffline(false)
 
-	return nil
+	fs.stats.IncPrepareForReadSuccessCount()
+	fs.stats.IncBytesRead(int64(prepared.Length))
+
+	if prepared.Offset > region.Offset || (prepared.Offset + prepared.Length) < (region.Offset + region.Length) {
+		return errors.New(fmt.Sprintf("Requested region %v but got %v", region, *prepared))
+	}
+
+	return fs.addedRegion(path, etag, localPath, size, *prepared)
+}
+
+// addedRegion records a region which was downloaded into the local file
+func (fs *FS) addedRegion(path string, etag, localPath string, size uint64, region Region) error {
+	err := fs.cache.AddedRegions(path, etag, region.Offset, region.Length)
+	if err != nil || !fs.options.VerifyChecksums {
+		return err
+	}
+	return fs.recordChecksums(path, etag, localPath, size, region)
+}
+
+func isCancellation(err error) bool {
+	return err == context.Canceled || err == context.DeadlineExceeded
 }
 
+// fuseError converts errors into what should be reported to the kernel.  BackendErrors carry their
+// own errno.
+func fuseError(err error) error {
+	if isCancellation(err) {
+		return fuse.EINTR
+	}
+	if err == ChecksumMismatch {
+		return fuse.EIO
+	}
+	return err
+}
+
+// FileHandle is an open file.  file, etag, size and readahead change if the handle is reopened
+// after the object changes, so they are guarded by lock.
 type FileHandle struct {
 	path string
 	fs   *FS
-	file *os.File
-	etag string
+
+	lock sync.Mutex
+	file     *os.File
+	etag     string
+	size     uint64
+	checksum string
+
+	// the blocks of file which have been checked against their checksums
+	verified map[uint64]bool
+	// the etag of the last version which was downloaded again after failing verification
+	refilled string
+
+	readahead *readahead
+	retired   []*os.File
+}
+
+func (f *FileHandle) current() (file *os.File, etag string, size uint64, ahead *readahead) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.file, f.etag, f.size, f.readahead
 }
 
 type Dir struct {
@@ -159,8 +452,11 @@ type Dir struct {
 type File struct {
 	path string
 	fs   *FS
-	size uint64
-	etag string
+
+	lock     sync.Mutex
+	size     uint64
+	etag     string
+	checksum string
 }
 
 func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
@@ -170,9 +466,9 @@ func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
 }
 
 func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
-	files, err := d.fs.ListDir(d.path)
+	files, err := d.fs.ListDir(ctx, d.path)
 	if err != nil {
-		return nil, err
+		return nil, fuseError(err)
 	}
 
 	entry := files.Get(name)
@@ -192,14 +488,14 @@ func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	if entry.IsDir {
 		return &Dir{path: childName, fs: d.fs}, nil
 	} else {
-		return &File{path: childName, fs: d.fs, size: entry.Size, etag: entry.Etag}, nil
+		return &File{path: childName, fs: d.fs, size: entry.Size, etag: entry.Etag, checksum: entry.Checksum}, nil
 	}
 }
 
 func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	filesv, err := d.fs.ListDir(d.path)
+	filesv, err := d.fs.ListDir(ctx, d.path)
 	if err != nil {
-		return nil, err
+		return nil, fuseError(err)
 	}
 	files := filesv.Files
 
@@ -223,15 +519,27 @@ func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	return dirDirs, nil
 }
 
-func (f *FileHandle) Forget() {
-	f.file.Close()
+func (f *FileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	f.fs.cache.FileClosed(f.path)
+	f.fs.handleReleased(f.path)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, retired := range f.retired {
+		retired.Close()
+	}
+	return f.file.Close()
 }
 
 func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
 	//	a.Inode = 2
-	fmt.Printf("File.Attr(%s) -> size=%d\n", f.path, f.size)
+	f.lock.Lock()
+	size := f.size
+	f.lock.Unlock()
+
+	fmt.Printf("File.Attr(%s) -> size=%d\n", f.path, size)
 	a.Mode = 0444
-	a.Size = f.size
+	a.Size = size
 	return nil
 }
 
@@ -239,32 +547,88 @@ func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenR
 
 	fmt.Printf("open(%s)\n", f.path)
 
-	localPath, err := f.fs.cache.GetLocalFile(f.path, f.size)
+	// the kernel may have looked the file up before it changed
+	stat, err := f.current(ctx)
 	if err != nil {
 		return nil, err
 	}
+
+	// mark the file open first, so it can't be evicted between creating the entry and opening it
+	f.fs.cache.FileOpened(f.path)
+	localPath, err := f.fs.cache.GetLocalFile(f.path, stat.Etag, stat.Size)
+	if err != nil {
+		f.fs.cache.FileClosed(f.path)
+		return nil, err
+	}
 	localFile, err := os.Open(localPath)
 	if err != nil {
+		f.fs.cache.FileClosed(f.path)
 		return nil, err
 	}
 
-	return &FileHandle{path: f.path, fs: f.fs, file: localFile, etag: f.etag}, nil
+	f.fs.handleOpened(f.path)
+	return &FileHandle{path: f.path, fs: f.fs, file: localFile, etag: stat.Etag, size: stat.Size, checksum: stat.Checksum,
+		verified: make(map[uint64]bool), readahead: &readahead{}}, nil
 }
 
 func (f *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
-	err := f.fs.PrepareForRead(f.path, f.etag, f.file.Name(), uint64(req.Offset), uint64(req.Size), nil)
+	etag, err := f.read(ctx, req, resp)
+	if err == UpdateDetected || err == NotInCache {
+		// the object changed, or someone else noticed it changed and evicted our copy
+		err = f.changed(ctx, etag)
+		if err == nil {
+			_, err = f.read(ctx, req, resp)
+		}
+	} else if err == ChecksumMismatch {
+		// the corrupt copy was evicted, so download it again
+		err = f.refill(etag)
+		if err == nil {
+			_, err = f.read(ctx, req, resp)
+		}
+	}
 	if err != nil {
-		fmt.Printf("PrepareForRead failed: %s\n", err.Error())
-		return err
+		fmt.Printf("Read of %s failed: %s\n", f.path, err.Error())
+		return fuseError(err)
 	}
 
-	buffer := make([]byte, req.Size)
-	n, err := f.file.ReadAt(buffer, req.Offset)
+	return nil
+}
+
+// read reads from the handle's current copy of the file, and returns the etag of that copy
+func (f *FileHandle) read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (string, error) {
+	file, etag, size, readahead := f.current()
+	if f.fs.changedSince(f.path, etag) {
+		return etag, UpdateDetected
+	}
+	if f.fs.checksumFailed(f.path, etag) {
+		return etag, ChecksumMismatch
+	}
+
+	err := f.fs.PrepareForRead(ctx, f.path, etag, file.Name(), size, uint64(req.Offset), uint64(req.Size), PriorityRead, nil)
 	if err != nil {
-		return err
+		return etag, err
+	}
+
+	buffer := make([]byte, req.Size)
+	n, err := file.ReadAt(buffer, req.Offset)
+	if err != nil && err != io.EOF {
+		return etag, err
+	}
+
+	if f.fs.options.VerifyChecksums {
+		err = f.verify(file, etag, size, Region{uint64(req.Offset), uint64(n)})
+		if err != nil {
+			return etag, err
+		}
 	}
 
 	// TODO: check, did caller allocate Data before this call?
 	resp.Data = buffer[:n]
-	return err
+
+	ahead := readahead.next(uint64(req.Offset), uint64(n), size, f.fs.options.MinReadahead, f.fs.options.MaxReadahead)
+	if ahead != nil {
+		f.startReadahead(file, etag, size, readahead, ahead)
+	}
+
+	return etag, nil
 }
@@ -0,0 +1,174 @@
+package singleply
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// TokenBucket limits the rate at which tokens can be taken.  The bucket starts full.  Takes larger
+// than the bucket holds are charged a bucketful at a time, so the bucket never goes into debt which
+// later takes would have to wait out.  A rate of zero means unlimited.
+type TokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	now   func() time.Time
+	sleep func(context.Context, time.Duration) error
+}
+
+func NewTokenBucket(rate float64, burst float64) *TokenBucket {
+	b := &TokenBucket{now: time.Now, sleep: sleepContext}
+	b.last = b.now()
+	b.SetRate(rate, burst)
+	return b
+}
+
+func (b *TokenBucket) SetRate(rate float64, burst float64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill()
+	if b.rate <= 0 {
+		// nothing was being charged while unlimited
+		b.tokens = burst
+	}
+	b.rate = rate
+	b.burst = burst
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+}
+
+func (b *TokenBucket) Rate() float64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.rate
+}
+
+// refill adds the tokens accumulated since the last call.  Must be called with lock held.
+func (b *TokenBucket) refill() {
+	now := b.now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Take removes n tokens, blocking until the bucket can afford them.  If ctx is done first, the tokens
+// taken so far are given back and ctx's error is returned.
+func (b *TokenBucket) Take(ctx context.Context, n float64) error {
+	var taken float64
+	for taken < n {
+		b.lock.Lock()
+		if b.rate <= 0 {
+			b.lock.Unlock()
+			return nil
+		}
+
+		b.refill()
+		chunk := n - taken
+		if b.burst > 0 && chunk > b.burst {
+			chunk = b.burst
+		}
+		if b.tokens >= chunk {
+			b.tokens -= chunk
+			taken += chunk
+			b.lock.Unlock()
+			continue
+		}
+		wait := time.Duration(math.Ceil((chunk - b.tokens) / b.rate * float64(time.Second)))
+		b.lock.Unlock()
+
+		if err := b.sleep(ctx, wait); err != nil {
+			b.lock.Lock()
+			b.tokens += taken
+			b.lock.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// Throttler is implemented by connectors which limit their request rate.  Throttle waits until a read
+// of length bytes may be sent, and charges for it.  Calling it before taking a scheduler slot keeps a
+// read which has to wait from holding a slot, and so from delaying reads of higher priority.  The
+// returned context carries the charge, so the PrepareForRead made with it is not charged again.
+type Throttler interface {
+	Throttle(ctx context.Context, length uint64) (context.Context, error)
+}
+
+type throttleKey struct{}
+
+// throttleTicket marks a context whose read has been paid for.  Only the first PrepareForRead made
+// with it is free, so retries are charged.
+type throttleTicket struct {
+	used int32
+}
+
+func paidFor(ctx context.Context) bool {
+	ticket, ok := ctx.Value(throttleKey{}).(*throttleTicket)
+	return ok && atomic.CompareAndSwapInt32(&ticket.used, 0, 1)
+}
+
+// RateLimitedConnector wraps another Connector and limits the bytes per second and requests per second
+// sent through it.  Zero limits are unlimited.  Limits can be changed while in use.
+type RateLimitedConnector struct {
+	connector Connector
+	bytes     *TokenBucket
+	requests  *TokenBucket
+}
+
+func NewRateLimitedConnector(connector Connector, bytesPerSecond uint64, requestsPerSecond uint64) *RateLimitedConnector {
+	c := &RateLimitedConnector{connector: connector, bytes: NewTokenBucket(0, 0), requests: NewTokenBucket(0, 0)}
+	c.SetLimits(bytesPerSecond, requestsPerSecond)
+	return c
+}
+
+// SetLimits changes the limits.  Each bucket can hold one second's worth of tokens.
+func (c *RateLimitedConnector) SetLimits(bytesPerSecond uint64, requestsPerSecond uint64) {
+	c.bytes.SetRate(float64(bytesPerSecond), float64(bytesPerSecond))
+	c.requests.SetRate(float64(requestsPerSecond), float64(max(requestsPerSecond, 1)))
+}
+
+func (c *RateLimitedConnector) Limits() (bytesPerSecond uint64, requestsPerSecond uint64) {
+	return uint64(c.bytes.Rate()), uint64(c.requests.Rate())
+}
+
+func (c *RateLimitedConnector) ListDir(ctx context.Context, path string, status StatusCallback) (*DirEntries, error) {
+	if err := c.requests.Take(ctx, 1); err != nil {
+		return nil, err
+	}
+	return c.connector.ListDir(ctx, path, status)
+}
+
+func (c *RateLimitedConnector) take(ctx context.Context, length uint64) error {
+	if err := c.requests.Take(ctx, 1); err != nil {
+		return err
+	}
+	return c.bytes.Take(ctx, float64(length))
+}
+
+func (c *RateLimitedConnector) Throttle(ctx context.Context, length uint64) (context.Context, error) {
+	if err := c.take(ctx, length); err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, throttleKey{}, &throttleTicket{}), nil
+}
+
+func (c *RateLimitedConnector) PrepareForRead(ctx context.Context, path string, etag string, localPath string, offset uint64, length uint64, status StatusCallback) (prepared *Region, err error) {
+	if !paidFor(ctx) {
+		if err := c.take(ctx, length); err != nil {
+			return nil, err
+		}
+	}
+	return c.connector.PrepareForRead(ctx, path, etag, localPath, offset, length, status)
+}
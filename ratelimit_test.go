@@ -0,0 +1,109 @@
+package singleply
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	. "gopkg.in/check.v1"
+)
+
+type RateLimitSuite struct{}
+
+var _ = Suite(&RateLimitSuite{})
+
+// fakeClock advances only when something sleeps on it
+type fakeClock struct {
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	c.sleeps = append(c.sleeps, d)
+	c.now = c.now.Add(d)
+	return nil
+}
+
+func (c *fakeClock) install(b *TokenBucket, rate float64, burst float64) {
+	b.now = c.Now
+	b.sleep = c.Sleep
+	b.last = c.now
+	b.rate = 0
+	b.SetRate(rate, burst)
+}
+
+func newTestBucket(rate float64, burst float64) (*TokenBucket, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	b := NewTokenBucket(0, 0)
+	clock.install(b, rate, burst)
+	return b, clock
+}
+
+func (s *RateLimitSuite) TestTokenBucket(c *C) {
+	b, clock := newTestBucket(100, 100)
+
+	// the bucket starts full
+	b.Take(context.Background(), 100)
+	c.Assert(clock.sleeps, HasLen, 0)
+	b.Take(context.Background(), 50)
+	c.Assert(clock.sleeps, DeepEquals, []time.Duration{500 * time.Millisecond})
+
+	// idle time refills it up to the burst size
+	clock.now = clock.now.Add(10 * time.Second)
+	b.Take(context.Background(), 50)
+	b.Take(context.Background(), 50)
+	c.Assert(clock.sleeps, HasLen, 1)
+
+	// large takes are charged a bucketful at a time, and leave no debt behind
+	b.Take(context.Background(), 250)
+	c.Assert(clock.sleeps[1:], DeepEquals, []time.Duration{time.Second, time.Second, 500 * time.Millisecond})
+	clock.now = clock.now.Add(time.Second)
+	b.Take(context.Background(), 100)
+	c.Assert(clock.sleeps, HasLen, 4)
+
+	// zero is unlimited, and the rate can be changed while in use
+	b.SetRate(0, 0)
+	b.Take(context.Background(), 1e9)
+	c.Assert(clock.sleeps, HasLen, 4)
+
+	b.SetRate(1000, 1000)
+	c.Assert(b.Rate(), Equals, float64(1000))
+	b.Take(context.Background(), 1500)
+	c.Assert(clock.sleeps[4:], DeepEquals, []time.Duration{500 * time.Millisecond})
+}
+
+func (s *RateLimitSuite) TestLimitsConnector(c *C) {
+	conn := newRecordingConn(&FileStat{Name: "f", Size: 1000, Etag: "1"})
+	limited := NewRateLimitedConnector(conn, 1000, 10)
+	bytesClock := &fakeClock{now: time.Unix(0, 0)}
+	bytesClock.install(limited.bytes, 1000, 1000)
+	requestsClock := &fakeClock{now: time.Unix(0, 0)}
+	requestsClock.install(limited.requests, 10, 10)
+
+	fs, cache := newTestFS(c, limited, &FSOptions{})
+	defer cache.Close()
+	localPath, err := cache.GetLocalFile("f", "1", 1000)
+	c.Assert(err, IsNil)
+
+	// the first read is covered by the full bucket, and each read is only charged once
+	err = fs.PrepareForRead(context.Background(), "f", "1", localPath, 1000, 0, 800, PriorityRead, nil)
+	c.Assert(err, IsNil)
+	c.Assert(bytesClock.sleeps, HasLen, 0)
+	err = fs.PrepareForRead(context.Background(), "f", "1", localPath, 1000, 800, 200, PriorityRead, nil)
+	c.Assert(err, IsNil)
+	c.Assert(bytesClock.sleeps, HasLen, 0)
+
+	// going around the FS, PrepareForRead charges for itself
+	_, err = limited.PrepareForRead(context.Background(), "f", "1", localPath, 0, 500, nil)
+	c.Assert(err, IsNil)
+	c.Assert(bytesClock.sleeps, DeepEquals, []time.Duration{500 * time.Millisecond})
+	c.Assert(requestsClock.sleeps, HasLen, 0)
+
+	limited.SetLimits(0, 5)
+	bytesPerSecond, requestsPerSecond := limited.Limits()
+	c.Assert(bytesPerSecond, Equals, uint64(0))
+	c.Assert(requestsPerSecond, Equals, uint64(5))
+}
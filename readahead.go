@@ -0,0 +1,94 @@
+package singleply
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// sequentialThreshold is how many back-to-back sequential reads it takes before readahead starts
+const sequentialThreshold = 2
+
+// readahead tracks the access pattern of a single FileHandle.  Once reads look sequential it fetches
+// ahead of the reader in the background, doubling the window each time.  Reads which jump around
+// halve the window and stop readahead until the reads are sequential again.
+type readahead struct {
+	lock       sync.Mutex
+	nextOffset uint64
+	sequential int
+	window     uint64
+	fetchedTo  uint64
+	inFlight   bool
+}
+
+// next records a read of length bytes at offset, and returns the region which should be fetched
+// in the background, if any.
+func (r *readahead) next(offset uint64, length uint64, size uint64, minWindow uint64, maxWindow uint64) *Region {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if offset == r.nextOffset {
+		r.sequential++
+	} else {
+		r.sequential = 0
+		r.window = r.window / 2
+		r.fetchedTo = 0
+	}
+	readEnd := offset + length
+	r.nextOffset = readEnd
+
+	if r.sequential < sequentialThreshold || r.inFlight || maxWindow == 0 {
+		return nil
+	}
+
+	// wait until the reader has consumed half of what was fetched ahead last time
+	if r.fetchedTo > readEnd+r.window/2 {
+		return nil
+	}
+
+	if r.window < minWindow {
+		r.window = minWindow
+	} else {
+		r.window = min(r.window*2, maxWindow)
+	}
+
+	start := max(readEnd, r.fetchedTo)
+	end := min(readEnd+r.window, size)
+	if end <= start {
+		return nil
+	}
+
+	r.fetchedTo = end
+	r.inFlight = true
+	return &Region{Offset: start, Length: end - start}
+}
+
+func (r *readahead) done() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.inFlight = false
+}
+
+// startReadahead fetches region of the given copy of the file in the background.  The file is treated
+// as open until the fetch completes so it cannot be evicted out from under it.
+func (f *FileHandle) startReadahead(file *os.File, etag string, size uint64, r *readahead, region *Region) {
+	f.fs.cache.FileOpened(f.path)
+	state := f.fs.tracker.AddOperation(fmt.Sprintf("Readahead(%s, %d, %d)", f.path, region.Offset, region.Length))
+
+	go func() {
+		defer f.fs.cache.FileClosed(f.path)
+		defer r.done()
+		defer f.fs.tracker.OperationComplete(state)
+
+		// readahead outlives the read which triggered it, so it is not tied to that read's context
+		err := f.fs.PrepareForRead(context.Background(), f.path, etag, file.Name(), size, region.Offset, region.Length, PriorityReadahead, state)
+		if err != nil {
+			fmt.Printf("Readahead of %s failed: %s\n", f.path, err.Error())
+			return
+		}
+		f.fs.stats.IncReadaheadBytes(int64(region.Length))
+	}()
+}
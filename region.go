@@ -1,5 +1,117 @@
 package singleply
 
+import "sort"
+
+// RegionSet records which byte ranges of a file are present.  Regions are kept sorted by offset,
+// and overlapping or adjacent regions are merged, so lookups are a binary search.
+type RegionSet struct {
+	Regions []Region
+}
+
+func (r *Region) end() uint64 {
+	return r.Offset + r.Length
+}
+
+func (rs *RegionSet) add(region Region) {
+	if region.Length == 0 {
+		return
+	}
+
+	start := region.Offset
+	end := region.end()
+
+	// find the first region which ends at or after the start of the new one.  Every region from there
+	// which starts at or before the end of the new one gets merged into it.
+	i := sort.Search(len(rs.Regions), func(i int) bool { return rs.Regions[i].end() >= start })
+	j := i
+	for j < len(rs.Regions) && rs.Regions[j].Offset <= end {
+		start = min(start, rs.Regions[j].Offset)
+		end = max(end, rs.Regions[j].end())
+		j++
+	}
+
+	merged := Region{Offset: start, Length: end - start}
+	rs.Regions = append(rs.Regions[:i], append([]Region{merged}, rs.Regions[j:]...)...)
+}
+
+// missing returns the sub-regions of region which are not in the set, in order
+func (rs *RegionSet) missing(region Region) []Region {
+	result := make([]Region, 0)
+
+	start := region.Offset
+	end := region.end()
+
+	i := sort.Search(len(rs.Regions), func(i int) bool { return rs.Regions[i].end() > start })
+	for ; i < len(rs.Regions) && start < end; i++ {
+		r := rs.Regions[i]
+		if r.Offset >= end {
+			break
+		}
+		if r.Offset > start {
+			result = append(result, Region{Offset: start, Length: r.Offset - start})
+		}
+		start = max(start, r.end())
+	}
+
+	if start < end {
+		result = append(result, Region{Offset: start, Length: end - start})
+	}
+
+	return result
+}
+
+func (rs *RegionSet) firstMissing(region Region) *Region {
+	missing := rs.missing(region)
+	if len(missing) == 0 {
+		return nil
+	}
+	return &missing[0]
+}
+
+// clip drops everything at or past limit, and reports whether anything was dropped
+func (rs *RegionSet) clip(limit uint64) bool {
+	clipped := false
+	regions := rs.Regions[:0]
+	for _, r := range rs.Regions {
+		if r.Offset >= limit {
+			clipped = true
+			continue
+		}
+		if r.end() > limit {
+			r.Length = limit - r.Offset
+			clipped = true
+		}
+		regions = append(regions, r)
+	}
+	rs.Regions = regions
+	return clipped
+}
+
+func (rs *RegionSet) total() uint64 {
+	var sum uint64
+	for _, r := range rs.Regions {
+		sum += r.Length
+	}
+	return sum
+}
+
+// normalize sorts and merges the regions.  Only needed for sets which were not built with add(),
+// such as those written by older versions.
+func (rs *RegionSet) normalize() bool {
+	normalized := &RegionSet{Regions: make([]Region, 0, len(rs.Regions))}
+	for _, r := range rs.Regions {
+		normalized.add(r)
+	}
+
+	changed := len(normalized.Regions) != len(rs.Regions)
+	for i := 0; !changed && i < len(rs.Regions); i++ {
+		changed = normalized.Regions[i] != rs.Regions[i]
+	}
+
+	rs.Regions = normalized.Regions
+	return changed
+}
+
 func (r *Region) FirstNonOverlap(r2 *Region) *Region {
 	overlap := r.Intersect(r2)
 	if overlap == nil {
@@ -56,3 +168,60 @@ func (r *Region) Union(r2 *Region) *Region {
 
 	return &Region{Offset: start, Length: end - start}
 }
+
+// alignRegion rounds r out to whole multiples of blockSize, without extending past fileSize
+func alignRegion(r Region, blockSize uint64, fileSize uint64) Region {
+	start := r.Offset - r.Offset%blockSize
+	end := r.end()
+	if end%blockSize != 0 {
+		end += blockSize - end%blockSize
+	}
+	end = min(end, max(fileSize, r.end()))
+	return Region{Offset: start, Length: end - start}
+}
+
+// alignRegions aligns each of the sorted regions to blockSize.  Regions which end up overlapping
+// are merged.
+func alignRegions(regions []Region, blockSize uint64, fileSize uint64) []Region {
+	var aligned RegionSet
+	for _, r := range regions {
+		aligned.add(alignRegion(r, blockSize, fileSize))
+	}
+	return aligned.Regions
+}
+
+// coalesceRegions merges consecutive regions which are separated by no more than maxGap bytes.  The
+// bytes in the gaps are included in the merged region.  regions must be sorted and non-overlapping.
+func coalesceRegions(regions []Region, maxGap uint64) []Region {
+	result := make([]Region, 0, len(regions))
+	for _, r := range regions {
+		if len(result) > 0 {
+			last := &result[len(result)-1]
+			if r.Offset-last.end() <= maxGap {
+				last.Length = r.end() - last.Offset
+				continue
+			}
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+// splitRegion divides r into at most maxParts parts of at least minPartSize bytes each.  Part
+// boundaries fall on multiples of blockSize when it is non-zero.
+func splitRegion(r Region, maxParts int, minPartSize uint64, blockSize uint64) []Region {
+	if maxParts <= 1 || r.Length <= minPartSize {
+		return []Region{r}
+	}
+
+	partSize := max(minPartSize, (r.Length+uint64(maxParts)-1)/uint64(maxParts))
+	if blockSize > 0 && partSize%blockSize != 0 {
+		partSize += blockSize - partSize%blockSize
+	}
+
+	parts := make([]Region, 0, maxParts)
+	for start := r.Offset; start < r.end(); start += partSize {
+		parts = append(parts, Region{Offset: start, Length: min(partSize, r.end()-start)})
+	}
+	return parts
+}
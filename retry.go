@@ -0,0 +1,170 @@
+package singleply
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+// RetryPolicy controls how RetryingConnector retries failed calls.  Attempts stop after MaxAttempts,
+// or when the next attempt would start more than Deadline after the first one.  A zero Deadline
+// means only MaxAttempts applies.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Deadline       time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 5, InitialBackoff: 100 * time.Millisecond, MaxBackoff: 10 * time.Second, Deadline: 2 * time.Minute}
+
+// RetryingConnector wraps another Connector and retries calls which fail with transient errors, such
+// as 5xx responses, throttling and dropped connections, using jittered exponential backoff.
+// UpdateDetected is never retried, and nothing is retried once the caller's context is done.
+type RetryingConnector struct {
+	connector Connector
+	policy    RetryPolicy
+	stats     *Stats
+	sleep     func(context.Context, time.Duration) error
+}
+
+func NewRetryingConnector(connector Connector, policy RetryPolicy, stats *Stats) *RetryingConnector {
+	return &RetryingConnector{connector: connector, policy: policy, stats: stats, sleep: sleepContext}
+}
+
+// sleepContext waits for d, or until ctx is done in which case it returns ctx's error
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func retryableStatus(code int) bool {
+	return code >= 500 || code == http.StatusTooManyRequests || code == http.StatusRequestTimeout
+}
+
+// isRetryable reports whether err looks transient, unwrapping the errors the various backends wrap
+// network failures in
+func isRetryable(err error) bool {
+	for err != nil {
+		if err == UpdateDetected {
+			return false
+		}
+		if err == io.ErrUnexpectedEOF {
+			return true
+		}
+
+		switch e := err.(type) {
+		case *BackendError:
+			return e.Kind == BackendThrottled || e.Kind == BackendTimeout
+		case *HTTPStatusError:
+			return retryableStatus(e.StatusCode)
+		case *googleapi.Error:
+			return retryableStatus(e.Code)
+		case awserr.RequestFailure:
+			if retryableStatus(e.StatusCode()) {
+				return true
+			}
+			err = e.OrigErr()
+		case awserr.Error:
+			err = e.OrigErr()
+		case *url.Error:
+			err = e.Err
+		case net.Error:
+			return true
+		case *os.SyscallError:
+			err = e.Err
+		case syscall.Errno:
+			return e == syscall.ECONNRESET || e == syscall.ECONNREFUSED || e == syscall.EPIPE || e == syscall.ETIMEDOUT
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// backoff returns how long to wait before the given retry (starting from 1), picked at random up to
+// an exponentially growing limit
+func (c *RetryingConnector) backoff(retry int) time.Duration {
+	limit := c.policy.InitialBackoff << uint(retry-1)
+	if limit > c.policy.MaxBackoff || limit <= 0 {
+		limit = c.policy.MaxBackoff
+	}
+	if limit <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(limit)))
+}
+
+func (c *RetryingConnector) retry(ctx context.Context, operation string, status StatusCallback, fn func() error) error {
+	start := time.Now()
+	attempt := 1
+	for {
+		if status != nil {
+			status.SetStatus(fmt.Sprintf("%s: attempt %d of %d", operation, attempt, c.policy.MaxAttempts))
+		}
+
+		err := fn()
+		if err == nil || ctx.Err() != nil || !isRetryable(err) || attempt >= c.policy.MaxAttempts {
+			return err
+		}
+
+		wait := c.backoff(attempt)
+		if c.policy.Deadline > 0 && time.Since(start)+wait > c.policy.Deadline {
+			return err
+		}
+
+		fmt.Printf("%s failed (attempt %d of %d), retrying in %s: %s\n", operation, attempt, c.policy.MaxAttempts, wait, err.Error())
+		if status != nil {
+			status.SetStatus(fmt.Sprintf("%s: attempt %d failed, retrying in %s: %s", operation, attempt, wait, err.Error()))
+		}
+		c.stats.IncRetryCount()
+		if sleepErr := c.sleep(ctx, wait); sleepErr != nil {
+			return sleepErr
+		}
+		attempt++
+	}
+}
+
+func (c *RetryingConnector) ListDir(ctx context.Context, path string, status StatusCallback) (*DirEntries, error) {
+	var files *DirEntries
+	err := c.retry(ctx, fmt.Sprintf("ListDir(%s)", path), status, func() error {
+		var err error
+		files, err = c.connector.ListDir(ctx, path, status)
+		return err
+	})
+	return files, err
+}
+
+// Throttle passes through to the wrapped connector, if it is a Throttler
+func (c *RetryingConnector) Throttle(ctx context.Context, length uint64) (context.Context, error) {
+	if throttler, ok := c.connector.(Throttler); ok {
+		return throttler.Throttle(ctx, length)
+	}
+	return ctx, nil
+}
+
+func (c *RetryingConnector) PrepareForRead(ctx context.Context, path string, etag string, localPath string, offset uint64, length uint64, status StatusCallback) (prepared *Region, err error) {
+	err = c.retry(ctx, fmt.Sprintf("PrepareForRead(%s, %d, %d)", path, offset, length), status, func() error {
+		var err error
+		prepared, err = c.connector.PrepareForRead(ctx, path, etag, localPath, offset, length, status)
+		return err
+	})
+	return prepared, err
+}
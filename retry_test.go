@@ -0,0 +1,112 @@
+package singleply
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/net/context"
+	. "gopkg.in/check.v1"
+)
+
+type RetrySuite struct{}
+
+var _ = Suite(&RetrySuite{})
+
+// flakyConn fails each call with the next error in failures until they run out
+type flakyConn struct {
+	*recordingConn
+	failures []error
+	calls    int
+}
+
+func (c *flakyConn) nextFailure() error {
+	c.calls++
+	if len(c.failures) == 0 {
+		return nil
+	}
+	err := c.failures[0]
+	c.failures = c.failures[1:]
+	return err
+}
+
+func (c *flakyConn) ListDir(ctx context.Context, path string, status StatusCallback) (*DirEntries, error) {
+	if err := c.nextFailure(); err != nil {
+		return nil, err
+	}
+	return c.recordingConn.ListDir(ctx, path, status)
+}
+
+func (c *flakyConn) PrepareForRead(ctx context.Context, path string, etag string, localPath string, offset uint64, length uint64, status StatusCallback) (*Region, error) {
+	if err := c.nextFailure(); err != nil {
+		return nil, err
+	}
+	return &Region{offset, length}, nil
+}
+
+type recordingStatus struct {
+	statuses []string
+}
+
+func (s *recordingStatus) SetStatus(status string) {
+	s.statuses = append(s.statuses, status)
+}
+
+func newTestRetryingConnector(conn Connector, policy RetryPolicy) (*RetryingConnector, *[]time.Duration) {
+	sleeps := make([]time.Duration, 0)
+	retrying := NewRetryingConnector(conn, policy, &Stats{})
+	retrying.sleep = func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		return ctx.Err()
+	}
+	return retrying, &sleeps
+}
+
+func (s *RetrySuite) TestRetriesTransientErrors(c *C) {
+	conn := &flakyConn{recordingConn: newRecordingConn(&FileStat{Name: "f"}),
+		failures: []error{&HTTPStatusError{StatusCode: 503}, io.ErrUnexpectedEOF, &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}}}
+	retrying, sleeps := newTestRetryingConnector(conn, RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Second, MaxBackoff: 3 * time.Second})
+
+	status := &recordingStatus{}
+	files, err := retrying.ListDir(context.Background(), "", status)
+	c.Assert(err, IsNil)
+	c.Assert(len(files.Files), Equals, 1)
+	c.Assert(conn.calls, Equals, 4)
+	c.Assert(retrying.stats.RetryCount, Equals, int32(3))
+
+	// backoff is jittered, but bounded by the exponentially growing limit and the maximum
+	c.Assert(len(*sleeps), Equals, 3)
+	for i, limit := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+		c.Assert((*sleeps)[i] < limit, Equals, true)
+	}
+
+	c.Assert(status.statuses[0], Equals, "ListDir(): attempt 1 of 5")
+	c.Assert(status.statuses[len(status.statuses)-1], Equals, "ListDir(): attempt 4 of 5")
+}
+
+func (s *RetrySuite) TestGivesUp(c *C) {
+	// permanent errors and UpdateDetected are returned immediately
+	for _, failure := range []error{UpdateDetected, &HTTPStatusError{StatusCode: 404}, errors.New("bad")} {
+		conn := &flakyConn{recordingConn: newRecordingConn(), failures: []error{failure}}
+		retrying, _ := newTestRetryingConnector(conn, DefaultRetryPolicy)
+		_, err := retrying.PrepareForRead(context.Background(), "f", "1", "", 0, 10, nil)
+		c.Assert(err, Equals, failure)
+		c.Assert(conn.calls, Equals, 1)
+	}
+
+	// transient errors are retried until attempts run out
+	failures := []error{&HTTPStatusError{StatusCode: 500}, &HTTPStatusError{StatusCode: 502}, &HTTPStatusError{StatusCode: 429}}
+	conn := &flakyConn{recordingConn: newRecordingConn(), failures: failures}
+	retrying, _ := newTestRetryingConnector(conn, RetryPolicy{MaxAttempts: 3})
+	_, err := retrying.PrepareForRead(context.Background(), "f", "1", "", 0, 10, nil)
+	c.Assert(err, Equals, failures[2])
+	c.Assert(conn.calls, Equals, 3)
+
+	// or the deadline passes
+	conn = &flakyConn{recordingConn: newRecordingConn(), failures: failures}
+	retrying, _ = newTestRetryingConnector(conn, RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Hour, MaxBackoff: time.Hour, Deadline: time.Nanosecond})
+	_, err = retrying.PrepareForRead(context.Background(), "f", "1", "", 0, 10, nil)
+	c.Assert(err, Equals, failures[0])
+	c.Assert(conn.calls, Equals, 1)
+}
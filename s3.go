@@ -7,12 +7,11 @@ import (
 	"os"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 //	"github.com/aws/aws-sdk-go/aws/defaults"
 	"github.com/aws/aws-sdk-go/service/s3"
     "github.com/aws/aws-sdk-go/aws/session"
-
+	"golang.org/x/net/context"
 )
 
 // type Connector interface {
@@ -22,31 +21,58 @@ import (
 
 var BadLength error = errors.New("Bad length read")
 
-func copyTo(localPath string, offset uint64, length uint64, reader io.ReadCloser) error {
+// offsetWriter writes sequentially into a file starting at a fixed offset using WriteAt, so several
+// writers can fill different regions of the same file concurrently.
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.offset)
+	o.offset += int64(n)
+	return n, err
+}
+
+// contextReader stops reading once ctx is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// copyTo writes what reader returns into the local file starting at offset, and returns how many bytes
+// were written, even if it fails part way through.
+func copyTo(ctx context.Context, localPath string, offset uint64, length uint64, reader io.ReadCloser) (uint64, error) {
 	defer reader.Close()
 
 	w, err := os.OpenFile(localPath, os.O_RDWR, 0777);
 	if err != nil {
-		return err
+		return 0, err
 	}
 	//fmt.Printf("copyTo(%s,%d,%d,%s)\n", localPath, offset, length, reader)
 	defer w.Close()
 
-	_, err = w.Seek(int64(offset), 0)
+	written, err := io.Copy(&offsetWriter{w: w, offset: int64(offset)}, &contextReader{ctx: ctx, r: reader})
 	if err != nil {
-		return err
-	}
-
-	written, err := io.Copy(w, reader)
-	if err != nil {
-		return err
+		if ctx.Err() != nil {
+			// a cancelled request fails with an error of the transport's own, so report why it happened
+			err = ctx.Err()
+		}
+		return uint64(written), err
 	}
 
 	if written != int64(length) {
-		return errors.New(fmt.Sprintf("Expected to write %d bytes, but wrote %d", length, written))
+		return uint64(written), errors.New(fmt.Sprintf("Expected to write %d bytes, but wrote %d", length, written))
 	}
 
-	return nil
+	return uint64(written), nil
 }
 
 type S3Connection struct {
@@ -55,27 +81,26 @@ type S3Connection struct {
 	region   string
 	endpoint string
 	svc      *s3.S3
-}
 
-var UpdateDetected error = errors.New("Detected change to file")
+	etagChecksums bool
+}
 
 func NewS3Connection(creds *credentials.Credentials, bucket string, prefix string, region string, endpoint string) *S3Connection {
 	config := aws.NewConfig().WithCredentials(creds).WithEndpoint(endpoint).WithRegion(region).WithS3ForcePathStyle(true)
 
 	svc := s3.New(session.New(), config)
 
-	return &S3Connection{bucket: bucket, prefix: prefix, region: region, endpoint: endpoint, svc: svc}
+	return &S3Connection{bucket: bucket, prefix: prefix, region: region, endpoint: endpoint, svc: svc, etagChecksums: true}
 }
 
-func isStatusCode(err error, code int) bool {
-	reqFailure, ok := err.(awserr.RequestFailure)
-	if !ok {
-		return false
-	}
-	return reqFailure.StatusCode() == code
+// SetEtagChecksums controls whether the etags of objects uploaded in a single part are reported as
+// their MD5 checksums.  It must be turned off for buckets with objects encrypted with SSE-KMS or SSE-C,
+// whose etags are not MD5s.
+func (c *S3Connection) SetEtagChecksums(enabled bool) {
+	c.etagChecksums = enabled
 }
 
-func (c *S3Connection) PrepareForRead(path string, etag string, localPath string, offset uint64, length uint64, status StatusCallback) (prepared *Region, err error) {
+func (c *S3Connection) PrepareForRead(ctx context.Context, path string, etag string, localPath string, offset uint64, length uint64, status StatusCallback) (prepared *Region, err error) {
 //	defaults.DefaultConfig.Region = aws.String("us-east-1")
 
 	key := c.prefix + "/" + path
@@ -84,24 +109,21 @@ func (c *S3Connection) PrepareForRead(path string, etag string, localPath string
 		Key:   &key,
 		Range: aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))}
 
-	result, err := c.svc.GetObject(&input)
+	result, err := c.svc.GetObjectWithContext(ctx, &input)
 	if err != nil {
-		if(isStatusCode(err, 412)) {
-			return nil, UpdateDetected
-		}
-		return nil, err
+		return nil, classifyS3Error(path, err)
 	}
 	
-	err = copyTo(localPath, offset, length, result.Body)
+	written, err := copyTo(ctx, localPath, offset, length, result.Body)
 
 	if err != nil {
-		return nil, err
+		return &Region{offset, written}, classifyS3Error(path, err)
 	}
 
 	return &Region{offset, length}, err
 }
 
-func (c *S3Connection) ListDir(path string, status StatusCallback) (*DirEntries, error) {
+func (c *S3Connection) ListDir(ctx context.Context, path string, status StatusCallback) (*DirEntries, error) {
 	files := make([]*FileStat, 0, 100)
 	if path != "" {
 		path = path + "/"
@@ -115,7 +137,7 @@ func (c *S3Connection) ListDir(path string, status StatusCallback) (*DirEntries,
 	// filtering to avoid issues with both key and directry with same name
 	dirNames := make(map[string]string)
 
-	err := c.svc.ListObjectsPages(&input, func(p *s3.ListObjectsOutput, lastPage bool) bool {
+	err := c.svc.ListObjectsPagesWithContext(ctx, &input, func(p *s3.ListObjectsOutput, lastPage bool) bool {
 		fmt.Printf("ListObjectPages returned %s\n", p)
 		
 		for _, p := range p.CommonPrefixes {
@@ -143,14 +165,18 @@ func (c *S3Connection) ListDir(path string, status StatusCallback) (*DirEntries,
 				continue
 			}
 
-			files = append(files, &FileStat{Name: name, IsDir: isDir, Size: uint64(*object.Size), Etag: *object.ETag})
+			stat := &FileStat{Name: name, IsDir: isDir, Size: uint64(*object.Size), Etag: *object.ETag}
+			if c.etagChecksums {
+				stat.Checksum = s3Checksum(*object.ETag)
+			}
+			files = append(files, stat)
 		}
 
 		return true
 	})
 
 	if err != nil {
-		return nil, err
+		return nil, classifyS3Error(path, err)
 	}
 
 	return &DirEntries{Files: files}, nil
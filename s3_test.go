@@ -10,6 +10,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/net/context"
 
 	. "gopkg.in/check.v1"
 )
@@ -127,7 +128,7 @@ func (s *S3Suite) TestS3ModifyDuringRead(c *C) {
 	
 	// make sure ListDir sees it
 	conn := NewS3Connection(credentials.AnonymousCredentials, "modified", "prefix", s.region, s.endpoint)
-	files, err := conn.ListDir("", nil)
+	files, err := conn.ListDir(context.Background(), "", nil)
 	c.Assert(err, IsNil)
 	c.Assert(len(files.Files), Equals, 1)
 	f := files.Files[0]
@@ -140,7 +141,7 @@ func (s *S3Suite) TestS3ModifyDuringRead(c *C) {
 	status := &NullStatusCallback{}
 	
 	// Perform a read
-	region, err := conn.PrepareForRead("banana", f.Etag, localPath, 0, 10, status)
+	region, err := conn.PrepareForRead(context.Background(), "banana", f.Etag, localPath, 0, 10, status)
 	c.Assert(err, IsNil)
 	c.Assert(region.Offset, Equals, uint64(0))
 	c.Assert(region.Length, Equals, uint64(10))
@@ -154,7 +155,7 @@ func (s *S3Suite) TestS3ModifyDuringRead(c *C) {
 	s.svc.PutObject(&putObject)
 
 	// try a read, and we should get a failure because data changed, and hence Etag
-	_, err = conn.PrepareForRead("banana", f.Etag, localPath, 10, 20, status)
+	_, err = conn.PrepareForRead(context.Background(), "banana", f.Etag, localPath, 10, 20, status)
 	c.Assert(err, Equals, UpdateDetected)
 }
 
@@ -164,7 +165,7 @@ func (s *S3Suite) TestS3Connection(c *C) {
 	c.Assert(err, IsNil)
 
 	conn := NewS3Connection(credentials.AnonymousCredentials, "bucket", "prefix", s.region, s.endpoint)
-	files, err := conn.ListDir("path", nil)
+	files, err := conn.ListDir(context.Background(), "path", nil)
 	c.Assert(err, IsNil)
 	c.Assert(len(files.Files), Equals, 0)
 
@@ -193,7 +194,7 @@ func (s *S3Suite) TestS3Connection(c *C) {
 	putObject.Body = bytes.NewReader(make([]byte, 0))
 	s.svc.PutObject(&putObject)
 
-	files, err = conn.ListDir("", nil)
+	files, err = conn.ListDir(context.Background(), "", nil)
 	fmt.Printf("files=%s\n", files)
 	c.Assert(err, IsNil)
 	c.Assert(len(files.Files), Equals, 2)
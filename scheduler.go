@@ -0,0 +1,163 @@
+package singleply
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+type Priority int
+
+const (
+	PriorityRead Priority = iota
+	PriorityReadahead
+	PriorityPrefetch
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityRead:
+		return "read"
+	case PriorityReadahead:
+		return "readahead"
+	case PriorityPrefetch:
+		return "prefetch"
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+// jobGroup holds the priority shared by all the jobs of one fetch, so that when a more urgent
+// reader starts waiting on the fetch every part of it can be promoted at once.
+type jobGroup struct {
+	priority Priority
+}
+
+type job struct {
+	group  *jobGroup
+	seq    uint64
+	status StatusCallback
+	fn     func()
+	done   chan bool
+}
+
+// Scheduler runs calls to the Connector on a bounded number of workers.  Queued jobs are started
+// in priority order, and in the order they were submitted within a priority.
+type Scheduler struct {
+	lock       sync.Mutex
+	maxWorkers int
+	workers    int
+	queue      []*job
+	nextSeq    uint64
+	stats      *Stats
+}
+
+func NewScheduler(maxWorkers int, stats *Stats) *Scheduler {
+	if maxWorkers < 1 {
+		maxWorkers = 1
+	}
+	return &Scheduler{maxWorkers: maxWorkers, stats: stats}
+}
+
+// Run queues fn and blocks until it has been executed by a worker.  While fn is waiting in the queue
+// its position is reported through status.  If ctx is done before fn starts, fn is dropped from the
+// queue and ctx's error is returned.  Once fn has started it is up to fn to watch ctx.
+func (s *Scheduler) Run(ctx context.Context, group *jobGroup, status StatusCallback, fn func()) error {
+	j := &job{group: group, status: status, fn: fn, done: make(chan bool)}
+
+	s.lock.Lock()
+	j.seq = s.nextSeq
+	s.nextSeq++
+	s.queue = append(s.queue, j)
+	s.stats.AddQueueDepth(group.priority, 1)
+	if status != nil {
+		status.SetStatus(fmt.Sprintf("queued (%s priority, %d queued)", group.priority, len(s.queue)))
+	}
+	if s.workers < s.maxWorkers {
+		s.workers++
+		go s.work()
+	}
+	s.lock.Unlock()
+
+	select {
+	case <-j.done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.lock.Lock()
+	for i, queued := range s.queue {
+		if queued == j {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			s.stats.AddQueueDepth(j.group.priority, -1)
+			s.lock.Unlock()
+			return ctx.Err()
+		}
+	}
+	s.lock.Unlock()
+
+	// a worker already picked it up
+	<-j.done
+	return nil
+}
+
+// promote raises the priority of every job in group to at least priority
+func (s *Scheduler) promote(group *jobGroup, priority Priority) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if priority >= group.priority {
+		return
+	}
+
+	for _, j := range s.queue {
+		if j.group == group {
+			s.stats.AddQueueDepth(group.priority, -1)
+			s.stats.AddQueueDepth(priority, 1)
+		}
+	}
+	group.priority = priority
+}
+
+// next removes and returns the most urgent job, or nil if the queue is empty.  Must be called with
+// lock held.
+func (s *Scheduler) next() *job {
+	if len(s.queue) == 0 {
+		return nil
+	}
+
+	best := 0
+	for i, j := range s.queue {
+		b := s.queue[best]
+		if j.group.priority < b.group.priority || (j.group.priority == b.group.priority && j.seq < b.seq) {
+			best = i
+		}
+	}
+
+	j := s.queue[best]
+	s.queue = append(s.queue[:best], s.queue[best+1:]...)
+	s.stats.AddQueueDepth(j.group.priority, -1)
+	return j
+}
+
+// work runs jobs until the queue is empty, and then exits
+func (s *Scheduler) work() {
+	for {
+		s.lock.Lock()
+		j := s.next()
+		if j == nil {
+			s.workers--
+			s.lock.Unlock()
+			return
+		}
+		s.lock.Unlock()
+
+		if j.status != nil {
+			j.status.SetStatus("running")
+		}
+		s.stats.AddActiveRequests(1)
+		j.fn()
+		s.stats.AddActiveRequests(-1)
+		close(j.done)
+	}
+}
@@ -5,13 +5,20 @@ import (
 	"fmt"
 	"os"
 	"encoding/json"
+	"io/ioutil"
 	"net/rpc"
 	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	_ "bazil.org/fuse/fs/fstestutil"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/codegangsta/cli"
 	"github.com/pgm/singleply"
+	"golang.org/x/net/context"
 
 	gcfg "gopkg.in/gcfg.v1"
 )
@@ -20,9 +27,21 @@ type SplyClient struct {
 	stats *singleply.Stats
 	tracker *singleply.Tracker
 	cache singleply.Cache
+	limiter *singleply.RateLimitedConnector
+	fs *singleply.FS
+
+	// prefetches in progress, and finished ones whose outcome has not been collected yet
+	prefetchLock sync.Mutex
+	prefetches map[int]*singleply.PrefetchProgress
+	nextPrefetch int
 }
 
 func (c *SplyClient) GetStats(args *string, result **string) error {
+	pinned, err := c.cache.PinnedBytes()
+	if err == nil {
+		c.stats.SetPinnedBytes(int64(pinned))
+	}
+
 	b, err := json.Marshal(c.stats)
 	if err != nil {
 		return err
@@ -35,8 +54,10 @@ func (c *SplyClient) GetStats(args *string, result **string) error {
 func (c *SplyClient) GetStatus(args *string, result **string) error {
 	states := c.tracker.GetState()
 	wrapper := struct {
+		Offline bool
 		States []*singleply.State
 	}{}
+	wrapper.Offline = c.stats.IsOffline()
 	wrapper.States = states
 	
 	b, err := json.Marshal(&wrapper)
@@ -61,6 +82,148 @@ func (c *SplyClient) Invalidate(path string, result **string) error {
 	return nil
 }
 
+type InvalidateArgs struct {
+	Path string
+	All  bool
+}
+
+// InvalidateRecursive marks the listings of a directory and every directory below it stale, or of
+// every directory if All is set
+func (c *SplyClient) InvalidateRecursive(args *InvalidateArgs, result **string) error {
+	path := strings.Trim(args.Path, "/")
+	if args.All {
+		path = ""
+	}
+
+	count, err := c.cache.InvalidateRecursive(path)
+	var r string
+	if err != nil {
+		r = err.Error()
+	} else {
+		c.stats.AddInvalidatedDirCount(int32(count))
+		r = fmt.Sprintf("invalidated %d listings", count)
+	}
+	*result = &r
+	return nil
+}
+
+type PinArgs struct {
+	Path      string
+	Recursive bool
+}
+
+// Pin pins the files at or below a path and downloads them, returning once they are all in the cache.
+// A recursive pin also covers files added below the path later, until it is unpinned recursively.
+func (c *SplyClient) Pin(args *PinArgs, result **string) error {
+	state := c.tracker.AddOperation(fmt.Sprintf("Pin(%s)", args.Path))
+	defer c.tracker.OperationComplete(state)
+
+	summary, err := c.fs.Pin(context.Background(), args.Path, args.Recursive, state)
+	var r string
+	if err != nil {
+		r = fmt.Sprintf("pinned %d files (%d bytes) before failing: %s", summary.Files, summary.Bytes, err.Error())
+	} else {
+		r = fmt.Sprintf("pinned %d files (%d bytes)", summary.Files, summary.Bytes)
+	}
+	*result = &r
+	return nil
+}
+
+func (c *SplyClient) Unpin(args *PinArgs, result **string) error {
+	removed, err := c.fs.Unpin(args.Path, args.Recursive)
+	var r string
+	if err != nil {
+		r = err.Error()
+	} else {
+		r = fmt.Sprintf("removed %d pins", removed)
+	}
+	*result = &r
+	return nil
+}
+
+type PrefetchArgs struct {
+	Path    string
+	Options singleply.PrefetchOptions
+}
+
+// StartPrefetch starts prefetching in the background and returns an id to poll PrefetchStatus with
+func (c *SplyClient) StartPrefetch(args *PrefetchArgs, result *int) error {
+	c.prefetchLock.Lock()
+	if c.prefetches == nil {
+		c.prefetches = make(map[int]*singleply.PrefetchProgress)
+	}
+	c.nextPrefetch++
+	id := c.nextPrefetch
+	c.prefetches[id] = &singleply.PrefetchProgress{}
+	c.prefetchLock.Unlock()
+
+	state := c.tracker.AddOperation(fmt.Sprintf("Prefetch(%s)", args.Path))
+	go func() {
+		defer c.tracker.OperationComplete(state)
+		c.fs.Prefetch(context.Background(), args.Path, args.Options, func(progress singleply.PrefetchProgress) {
+			state.SetStatus(progress.String())
+
+			c.prefetchLock.Lock()
+			c.prefetches[id] = &progress
+			c.prefetchLock.Unlock()
+		})
+	}()
+
+	*result = id
+	return nil
+}
+
+// PrefetchStatus returns the progress of a prefetch.  Once it reports the prefetch is done, the id is
+// forgotten.
+func (c *SplyClient) PrefetchStatus(id *int, result *singleply.PrefetchProgress) error {
+	c.prefetchLock.Lock()
+	defer c.prefetchLock.Unlock()
+
+	progress, ok := c.prefetches[*id]
+	if !ok {
+		return fmt.Errorf("No prefetch with id %d", *id)
+	}
+	if progress.Done {
+		delete(c.prefetches, *id)
+	}
+	*result = *progress
+	return nil
+}
+
+type EvictArgs struct {
+	Path    string
+	Options singleply.EvictOptions
+}
+
+func (c *SplyClient) Evict(args *EvictArgs, result **string) error {
+	state := c.tracker.AddOperation(fmt.Sprintf("Evict(%s)", args.Path))
+	defer c.tracker.OperationComplete(state)
+
+	summary, err := c.fs.Evict(context.Background(), args.Path, args.Options)
+	r := fmt.Sprintf("evicted %d files (%d bytes freed), skipped %d open and %d pinned files",
+		summary.Files, summary.Bytes, summary.SkippedOpen, summary.SkippedPinned)
+	if args.Options.DropListings {
+		r += fmt.Sprintf(", dropped %d listings", summary.Listings)
+	}
+	if err != nil {
+		r += fmt.Sprintf(" before failing: %s", err.Error())
+	}
+	*result = &r
+	return nil
+}
+
+type RateLimitArgs struct {
+	BytesPerSecond    uint64
+	RequestsPerSecond uint64
+}
+
+func (c *SplyClient) SetRateLimit(args *RateLimitArgs, result **string) error {
+	c.limiter.SetLimits(args.BytesPerSecond, args.RequestsPerSecond)
+	r := "okay"
+	*result = &r
+	return nil
+}
+
 func ConnectToServer(addr string) *rpc.Client {
 	client, err := rpc.Dial("unix", addr)
 	if err != nil {
@@ -110,15 +273,41 @@ type Config struct {
 			Bucket          string
 			Prefix          string
 			Region          string
+			// NoEtagChecksums must be set for buckets with objects encrypted with SSE-KMS or SSE-C,
+			// whose etags are not MD5s, when VerifyChecksums is on
+			NoEtagChecksums bool
 		}
 		GCS struct {
 			Prefix string
 			Bucket string
 		}
+		Local struct {
+			Root      string
+			HashEtags bool
+		}
+		HTTP struct {
+			URL      string
+			Manifest string
+		}
 		Settings struct {
 			MountPoint string
 			CacheDir   string
+			Namespace  string
 			ControlFile string
+			MaxCacheSize string
+			MinFreeSpace string
+			MaxGap string
+			BlockSize string
+			MaxReadahead string
+			MaxConcurrentRequests int
+			RetryAttempts int
+			RetryDeadline string
+			MaxBytesPerSecond string
+			MaxRequestsPerSecond uint64
+			UpdatePolicy string
+			Durability string
+			CommitInterval string
+			VerifyChecksums bool
 		}
 	}
 
@@ -138,6 +327,187 @@ func loadConfig(configFile string) *Config {
 	return &cfg	
 }
 
+// parseSize parses a byte count such as "512M" or "10G".  An empty string is treated as zero.
+func parseSize(value string) (uint64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+
+	multiplier := uint64(1)
+	switch strings.ToUpper(value[len(value)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	case "T":
+		multiplier = 1 << 40
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * multiplier, nil
+}
+
+func evictionPolicy(cfg *Config) singleply.EvictionPolicy {
+	maxSize, err := parseSize(cfg.Settings.MaxCacheSize)
+	if err != nil {
+		log.Fatalf("Invalid MaxCacheSize \"%s\": %s", cfg.Settings.MaxCacheSize, err)
+	}
+	minFree, err := parseSize(cfg.Settings.MinFreeSpace)
+	if err != nil {
+		log.Fatalf("Invalid MinFreeSpace \"%s\": %s", cfg.Settings.MinFreeSpace, err)
+	}
+	return singleply.EvictionPolicy{MaxSize: maxSize, MinFreeSpace: minFree}
+}
+
+func setDurability(cache *singleply.LocalCache, cfg *Config) {
+	durability := singleply.DurabilityRegion
+	if cfg.Settings.Durability != "" {
+		var err error
+		durability, err = singleply.ParseDurability(cfg.Settings.Durability)
+		if err != nil {
+			log.Fatalf("Invalid Durability: %s", err)
+		}
+	}
+	var interval time.Duration
+	if cfg.Settings.CommitInterval != "" {
+		var err error
+		interval, err = time.ParseDuration(cfg.Settings.CommitInterval)
+		if err != nil {
+			log.Fatalf("Invalid CommitInterval \"%s\": %s", cfg.Settings.CommitInterval, err)
+		}
+	}
+	cache.SetDurability(durability, interval)
+}
+
+func fsOptions(cfg *Config) *singleply.FSOptions {
+	options := singleply.DefaultFSOptions()
+	if cfg.Settings.MaxGap != "" {
+		maxGap, err := parseSize(cfg.Settings.MaxGap)
+		if err != nil {
+			log.Fatalf("Invalid MaxGap \"%s\": %s", cfg.Settings.MaxGap, err)
+		}
+		options.MaxGap = maxGap
+	}
+	if cfg.Settings.BlockSize != "" {
+		blockSize, err := parseSize(cfg.Settings.BlockSize)
+		if err != nil {
+			log.Fatalf("Invalid BlockSize \"%s\": %s", cfg.Settings.BlockSize, err)
+		}
+		options.BlockSize = blockSize
+	}
+	if cfg.Settings.MaxReadahead != "" {
+		maxReadahead, err := parseSize(cfg.Settings.MaxReadahead)
+		if err != nil {
+			log.Fatalf("Invalid MaxReadahead \"%s\": %s", cfg.Settings.MaxReadahead, err)
+		}
+		options.MaxReadahead = maxReadahead
+	}
+	if cfg.Settings.MaxConcurrentRequests > 0 {
+		options.MaxConcurrentRequests = cfg.Settings.MaxConcurrentRequests
+	}
+	if cfg.Settings.UpdatePolicy != "" {
+		policy, err := singleply.ParseUpdatePolicy(cfg.Settings.UpdatePolicy)
+		if err != nil {
+			log.Fatalf("Invalid UpdatePolicy: %s", err)
+		}
+		options.UpdatePolicy = policy
+	}
+	options.VerifyChecksums = cfg.Settings.VerifyChecksums
+	return options
+}
+
+func newConnection(cfg *Config) singleply.Connector {
+	if cfg.GCS.Bucket != "" {
+		return singleply.NewGCSConnection(cfg.GCS.Bucket, cfg.GCS.Prefix)
+	} else if cfg.S3.Bucket != "" {
+		s3creds := credentials.NewStaticCredentials(cfg.S3.AccessKeyId, cfg.S3.SecretAccessKey, "")
+		conn := singleply.NewS3Connection(s3creds, cfg.S3.Bucket, cfg.S3.Prefix, cfg.S3.Region, cfg.S3.Endpoint)
+		conn.SetEtagChecksums(!cfg.S3.NoEtagChecksums)
+		return conn
+	} else if cfg.Local.Root != "" {
+		return singleply.NewLocalDirConnector(cfg.Local.Root, cfg.Local.HashEtags)
+	} else if cfg.HTTP.URL != "" {
+		return singleply.NewHTTPConnection(cfg.HTTP.URL, cfg.HTTP.Manifest)
+	}
+	panic("Needed either GCS bucket, S3 bucket, local root or HTTP URL selected")
+}
+
+// fsckCache checks an open cache and prints what was repaired
+func fsckCache(cache *singleply.LocalCache, name string) {
+	report, err := cache.Fsck()
+	if err != nil {
+		log.Fatalf("Checking cache %s failed: %s", name, err.Error())
+	}
+	fmt.Printf("Checked cache %s: %s\n", name, report)
+}
+
+// fsckCacheDir checks the cache in dir, and the cache of each namespace under it
+func fsckCacheDir(dir string) {
+	dirs := make([]string, 0)
+	if _, err := os.Stat(filepath.Join(dir, "db")); err == nil {
+		dirs = append(dirs, dir)
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Fatalf("Could not read %s: %s", dir, err.Error())
+	}
+	for _, info := range infos {
+		namespaceDir := filepath.Join(dir, info.Name())
+		if _, err := os.Stat(filepath.Join(namespaceDir, "db")); info.IsDir() && err == nil {
+			dirs = append(dirs, namespaceDir)
+		}
+	}
+	if len(dirs) == 0 {
+		log.Fatalf("No cache found in %s", dir)
+	}
+
+	for _, cacheDir := range dirs {
+		cache, err := singleply.NewLocalCache(cacheDir)
+		if err != nil {
+			log.Fatalf("Could not open cache in %s (is it mounted?): %s", cacheDir, err.Error())
+		}
+		fsckCache(cache, cacheDir)
+		cache.Close()
+	}
+}
+
+func retryPolicy(cfg *Config) singleply.RetryPolicy {
+	policy := singleply.DefaultRetryPolicy
+	if cfg.Settings.RetryAttempts > 0 {
+		policy.MaxAttempts = cfg.Settings.RetryAttempts
+	}
+	if cfg.Settings.RetryDeadline != "" {
+		deadline, err := time.ParseDuration(cfg.Settings.RetryDeadline)
+		if err != nil {
+			log.Fatalf("Invalid RetryDeadline \"%s\": %s", cfg.Settings.RetryDeadline, err)
+		}
+		policy.Deadline = deadline
+	}
+	return policy
+}
+
+func callPin(method string, c *cli.Context) {
+	configFile := c.Args().Get(0)
+	path := c.Args().Get(1)
+	cfg := loadConfig(configFile)
+	client := ConnectToServer(cfg.Settings.ControlFile)
+	var result *string
+	err := client.Call(method, &PinArgs{Path: path, Recursive: c.Bool("recursive")}, &result)
+	if err != nil {
+		log.Fatalf("%s failed: %s", method, err.Error())
+	}
+	fmt.Printf("status: %s\n", *result)
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "splymnt"
@@ -150,19 +520,137 @@ func main() {
 	app.Commands = []cli.Command{
 		{
 			Name:  "invalidate",
-			Usage: "invalidate",
+			Usage: "invalidate [--recursive | --all] <config> [path]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "recursive", Usage: "Also invalidate every directory below the path"},
+				cli.BoolFlag{Name: "all", Usage: "Invalidate every directory"},
+			},
 			Action: func(c *cli.Context) {
 				configFile := c.Args().Get(0)
 				path := c.Args().Get(1)
 				cfg := loadConfig(configFile)
 				client := ConnectToServer(cfg.Settings.ControlFile)
 				var result *string
-				err := client.Call("SplyClient.Invalidate", path, &result)
+				var err error
+				if c.Bool("recursive") || c.Bool("all") {
+					err = client.Call("SplyClient.InvalidateRecursive", &InvalidateArgs{Path: path, All: c.Bool("all")}, &result)
+				} else {
+					err = client.Call("SplyClient.Invalidate", path, &result)
+				}
 				if err != nil {
 					log.Fatalf("SplyClient.Invalidate failed: %s", err.Error())
 				}
 				fmt.Printf("status: %s\n", *result)
 			}},
+		{
+			Name:  "pin",
+			Usage: "pin [--recursive] <config> <path>",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "recursive", Usage: "Pin every file below the directory, including files added later"},
+			},
+			Action: func(c *cli.Context) {
+				callPin("SplyClient.Pin", c)
+			}},
+		{
+			Name:  "unpin",
+			Usage: "unpin [--recursive] <config> <path>",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "recursive", Usage: "Unpin every file below the directory"},
+			},
+			Action: func(c *cli.Context) {
+				callPin("SplyClient.Unpin", c)
+			}},
+		{
+			Name:  "prefetch",
+			Usage: "prefetch [--recursive] [--include glob] [--dry-run] <config> <path>",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "recursive", Usage: "Prefetch every file below the directory"},
+				cli.StringFlag{Name: "include", Usage: "Only prefetch files whose name matches the glob"},
+				cli.BoolFlag{Name: "dry-run", Usage: "Report what would be fetched without fetching it"},
+			},
+			Action: func(c *cli.Context) {
+				configFile := c.Args().Get(0)
+				path := c.Args().Get(1)
+				cfg := loadConfig(configFile)
+				client := ConnectToServer(cfg.Settings.ControlFile)
+
+				args := &PrefetchArgs{Path: path, Options: singleply.PrefetchOptions{
+					Recursive: c.Bool("recursive"),
+					Include:   c.String("include"),
+					DryRun:    c.Bool("dry-run")}}
+				var id int
+				err := client.Call("SplyClient.StartPrefetch", args, &id)
+				if err != nil {
+					log.Fatalf("SplyClient.StartPrefetch failed: %s", err.Error())
+				}
+
+				for {
+					var progress singleply.PrefetchProgress
+					err = client.Call("SplyClient.PrefetchStatus", &id, &progress)
+					if err != nil {
+						log.Fatalf("SplyClient.PrefetchStatus failed: %s", err.Error())
+					}
+					if progress.Done {
+						if args.Options.DryRun {
+							fmt.Printf("would fetch %d files (%d bytes)\n", progress.Files, progress.Bytes)
+						} else {
+							fmt.Printf("%s\n", progress.String())
+						}
+						if progress.Error != "" {
+							log.Fatalf("Prefetch failed: %s", progress.Error)
+						}
+						break
+					}
+					fmt.Printf("%s\n", progress.String())
+					time.Sleep(time.Second)
+				}
+			}},
+		{
+			Name:  "evict",
+			Usage: "evict [--recursive] [--listings] [--wait] <config> <path>",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "recursive", Usage: "Evict files in every directory below the path"},
+				cli.BoolFlag{Name: "listings", Usage: "Also drop the cached directory listings"},
+				cli.BoolFlag{Name: "wait", Usage: "Wait for open files to be closed instead of skipping them"},
+			},
+			Action: func(c *cli.Context) {
+				configFile := c.Args().Get(0)
+				path := c.Args().Get(1)
+				cfg := loadConfig(configFile)
+				client := ConnectToServer(cfg.Settings.ControlFile)
+				args := &EvictArgs{Path: path, Options: singleply.EvictOptions{
+					Recursive:    c.Bool("recursive"),
+					DropListings: c.Bool("listings"),
+					WaitForOpen:  c.Bool("wait")}}
+				var result *string
+				err := client.Call("SplyClient.Evict", args, &result)
+				if err != nil {
+					log.Fatalf("SplyClient.Evict failed: %s", err.Error())
+				}
+				fmt.Printf("status: %s\n", *result)
+			}},
+		{
+			Name:  "ratelimit",
+			Usage: "ratelimit <config> <bytes per second> <requests per second>",
+			Action: func(c *cli.Context) {
+				configFile := c.Args().Get(0)
+				bytesPerSecond, err := parseSize(c.Args().Get(1))
+				if err != nil {
+					log.Fatalf("Invalid bytes per second: %s", err.Error())
+				}
+				requestsPerSecond, err := strconv.ParseUint(c.Args().Get(2), 10, 64)
+				if err != nil {
+					log.Fatalf("Invalid requests per second: %s", err.Error())
+				}
+				cfg := loadConfig(configFile)
+				client := ConnectToServer(cfg.Settings.ControlFile)
+				var result *string
+				err = client.Call("SplyClient.SetRateLimit", &RateLimitArgs{BytesPerSecond: bytesPerSecond, RequestsPerSecond: requestsPerSecond}, &result)
+				if err != nil {
+					log.Fatalf("SplyClient.SetRateLimit failed: %s", err.Error())
+				}
+				fmt.Printf("status: %s\n", *result)
+			}},
 		{
 			Name:  "status",
 			Usage: "status",
@@ -193,6 +681,12 @@ func main() {
 				}
 				fmt.Printf("stats: %s\n", *result)
 			}},
+		{
+			Name:  "fsck",
+			Usage: "fsck <cachedir>",
+			Action: func(c *cli.Context) {
+				fsckCacheDir(c.Args().Get(0))
+			}},
 		{
 			Name:  "mount",
 			Usage: "mount",
@@ -203,46 +697,53 @@ func main() {
 				if err != nil {
 					panic(err.Error())
 				}
+				fsckCache(cache, cacheDir)
 
 				stats := &singleply.Stats{}
 				connection := &singleply.MockConn{}
 				fs := singleply.NewFileSystem(connection,
 					cache,
-					singleply.NewTracker(), stats)
+					singleply.NewTracker(), stats, nil)
 
 				singleply.StartMount(mountPoint, fs)
 			}},
 		{
 			Name:  "s3mount",
-			Usage: "s3mount",
+			Usage: "s3mount [--wipe] <config>",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "wipe", Usage: "Delete the contents of the cache namespace if it holds data from a different backend"},
+			},
 			Action: func(c *cli.Context) {
 				configFile := c.Args().Get(0)
 
 				cfg := loadConfig(configFile)
+				backend := newConnection(cfg)
 
-				cache, err := singleply.NewLocalCache(cfg.Settings.CacheDir)
+				cache, err := singleply.OpenNamespacedCache(cfg.Settings.CacheDir, cfg.Settings.Namespace, singleply.ConnectorIdentity(backend), c.Bool("wipe"))
 				if err != nil {
-					panic(err.Error())
+					log.Fatalf("Could not open cache: %s", err.Error())
 				}
+				fsckCache(cache, cfg.Settings.CacheDir)
+				setDurability(cache, cfg)
 
-				var connection singleply.Connector
-				if cfg.GCS.Bucket != "" {
-					connection = singleply.NewGCSConnection(cfg.GCS.Bucket, cfg.GCS.Prefix)
-				} else if cfg.S3.Bucket != "" {
-					s3creds := credentials.NewStaticCredentials(cfg.S3.AccessKeyId, cfg.S3.SecretAccessKey, "")
-					connection = singleply.NewS3Connection(s3creds, cfg.S3.Bucket, cfg.S3.Prefix, cfg.S3.Region, cfg.S3.Endpoint)
-				} else {
-					panic("Needed either GCS bucket or S3 bucket selected")
+				stats := &singleply.Stats{}
+				cache.StartEviction(evictionPolicy(cfg), stats)
+
+				maxBytesPerSecond, err := parseSize(cfg.Settings.MaxBytesPerSecond)
+				if err != nil {
+					log.Fatalf("Invalid MaxBytesPerSecond \"%s\": %s", cfg.Settings.MaxBytesPerSecond, err)
 				}
+				limiter := singleply.NewRateLimitedConnector(backend, maxBytesPerSecond, cfg.Settings.MaxRequestsPerSecond)
+				connection := singleply.NewRetryingConnector(limiter, retryPolicy(cfg), stats)
 
-				stats := &singleply.Stats{}
 				tracker := singleply.NewTracker()
 				fs := singleply.NewFileSystem(connection,
 					cache,
 					tracker,
-					stats)
+					stats,
+					fsOptions(cfg))
 
-				client := SplyClient{stats: stats, tracker: tracker, cache: cache}
+				client := SplyClient{stats: stats, tracker: tracker, cache: cache, limiter: limiter, fs: fs}
 
 				_, err = StartServer(cfg.Settings.ControlFile, &client)
 				if err != nil {
@@ -11,16 +11,61 @@ type Stats struct {
 	PrepareForReadSuccessCount int32
 	PrepareForReadFailedCount int32
 	BytesRead int64
+	ReadaheadBytes int64
 	FilesRead int32
 	FilesEvicted int32
+	BytesEvicted int64
 	GotStaleDirCount int32
 	InvalidatedDirCount int32
+	WaitedOnFetchCount int32
+	RetryCount int32
+
+	// UpdateDetectedCount counts files which changed while open, and FilesReopened the open handles
+	// which were switched over to the new contents
+	UpdateDetectedCount int32
+	FilesReopened int32
+
+	// ChecksumMismatchCount counts copies of files which failed verification
+	ChecksumMismatchCount int32
+
+	// PinnedBytes is how much of the cache is taken by pinned files, as of when it was last counted
+	PinnedBytes int64
+
+	// Offline is 1 while the backend is unreachable and reads are being served from the cache
+	Offline int32
+	OfflineFallbackCount int32
+
+	// the number of connector requests waiting in the scheduler queue for each priority, and running
+	QueuedReads int32
+	QueuedReadahead int32
+	QueuedPrefetch int32
+	ActiveRequests int32
 }
 
 func (s *Stats) IncInvalidatedDirCount() {
 	atomic.AddInt32(&s.InvalidatedDirCount, 1)
 }
 
+func (s *Stats) AddInvalidatedDirCount(count int32) {
+	atomic.AddInt32(&s.InvalidatedDirCount, count)
+}
+
+func (s *Stats) IncUpdateDetectedCount() {
+	atomic.AddInt32(&s.UpdateDetectedCount, 1)
+}
+
+func (s *Stats) SetPinnedBytes(count int64) {
+	atomic.StoreInt64(&s.PinnedBytes, count)
+}
+
+func (s *Stats) IncChecksumMismatchCount() {
+	atomic.AddInt32(&s.ChecksumMismatchCount, 1)
+}
+
+func (s *Stats) IncFilesReopened() {
+	atomic.AddInt32(&s.FilesReopened, 1)
+}
+
 func (s *Stats) IncGotStaleDirCount() {
 	atomic.AddInt32(&s.GotStaleDirCount, 1)
 }
@@ -34,6 +79,10 @@ func (s *Stats) IncFilesEvicted() {
 	atomic.AddInt32(&s.FilesEvicted, 1);
 }
 
+func (s *Stats) IncBytesEvicted(count int64) {
+	atomic.AddInt64(&s.BytesEvicted, count)
+}
+
 func (s *Stats) IncListDirFailedCount() {
 	atomic.AddInt32(&s.ListDirFailedCount, 1);
 }
@@ -50,6 +99,49 @@ func (s *Stats) IncBytesRead(count int64) {
 	atomic.AddInt64(&s.BytesRead, count)
 }
 
+func (s *Stats) IncReadaheadBytes(count int64) {
+	atomic.AddInt64(&s.ReadaheadBytes, count)
+}
+
+func (s *Stats) IncWaitedOnFetchCount() {
+	atomic.AddInt32(&s.WaitedOnFetchCount, 1)
+}
+
+func (s *Stats) IncRetryCount() {
+	atomic.AddInt32(&s.RetryCount, 1)
+}
+
+// SetOffline records whether the backend is reachable, and returns true if that changed
+func (s *Stats) SetOffline(offline bool) bool {
+	if offline {
+		return atomic.CompareAndSwapInt32(&s.Offline, 0, 1)
+	}
+	return atomic.CompareAndSwapInt32(&s.Offline, 1, 0)
+}
+
+func (s *Stats) IsOffline() bool {
+	return atomic.LoadInt32(&s.Offline) != 0
+}
+
+func (s *Stats) IncOfflineFallbackCount() {
+	atomic.AddInt32(&s.OfflineFallbackCount, 1)
+}
+
+func (s *Stats) AddQueueDepth(priority Priority, delta int32) {
+	switch priority {
+	case PriorityRead:
+		atomic.AddInt32(&s.QueuedReads, delta)
+	case PriorityReadahead:
+		atomic.AddInt32(&s.QueuedReadahead, delta)
+	case PriorityPrefetch:
+		atomic.AddInt32(&s.QueuedPrefetch, delta)
+	}
+}
+
+func (s *Stats) AddActiveRequests(delta int32) {
+	atomic.AddInt32(&s.ActiveRequests, delta)
+}
+
 func (s *Stats) IncFilesRead() {
 	atomic.AddInt32(&s.FilesRead, 1)
 }
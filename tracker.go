@@ -1,12 +1,16 @@
 package singleply
 
-import "sync"
+import (
+	"encoding/json"
+	"sync"
+)
 
 type StatusCallback interface {
 	SetStatus(status string)
 }
 
 type State struct {
+	lock      sync.Mutex
 	operation string
 	latest    string
 }
@@ -42,13 +46,25 @@ func (s *Tracker) GetState() []*State {
 	defer s.lock.Unlock()
 
 	states := make([]*State, 0, len(s.states))
-	for _, st := range states {
+	for _, st := range s.states {
+		st.lock.Lock()
 		states = append(states, &State{operation: st.operation, latest: st.latest})
+		st.lock.Unlock()
 	}
 
 	return states
 }
 
 func (s *State) SetStatus(status string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	s.latest = status
 }
+
+func (s *State) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		Operation string
+		Latest    string
+	}{s.operation, s.latest})
+}
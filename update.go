@@ -0,0 +1,247 @@
+package singleply
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// UpdatePolicy says what happens to an open file when the object behind it changes while it is
+// being read
+type UpdatePolicy int
+
+const (
+	// UpdateFail fails reads of the open file with ESTALE.  Opening the file again sees the new
+	// contents.
+	UpdateFail UpdatePolicy = iota
+
+	// UpdateReopen switches the open file over to the new contents and retries the read
+	UpdateReopen
+)
+
+func (p UpdatePolicy) String() string {
+	switch p {
+	case UpdateFail:
+		return "fail"
+	case UpdateReopen:
+		return "reopen"
+	}
+	return fmt.Sprintf("UpdatePolicy(%d)", int(p))
+}
+
+func ParseUpdatePolicy(s string) (UpdatePolicy, error) {
+	switch strings.ToLower(s) {
+	case "fail":
+		return UpdateFail, nil
+	case "reopen":
+		return UpdateReopen, nil
+	}
+	return UpdateFail, fmt.Errorf("Unknown update policy \"%s\", expected fail or reopen", s)
+}
+
+func parentPath(path string) string {
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		return ""
+	}
+	return path[:i]
+}
+
+// changedSince reports whether path is known to have been replaced by something other than etag
+func (fs *FS) changedSince(path string, etag string) bool {
+	fs.updateLock.Lock()
+	defer fs.updateLock.Unlock()
+
+	current, changed := fs.updated[path]
+	return changed && current != etag
+}
+
+// fileChanged is called when the copy of path with etag turns out to be out of date.  The first time
+// a change is noticed, the stale copy is evicted and the parent directory is listed again.  Returns the
+// current stat of the file, or nil if it no longer exists.
+func (fs *FS) fileChanged(ctx context.Context, path string, etag string) (*FileStat, error) {
+	parent := parentPath(path)
+
+	fs.updateLock.Lock()
+	current, changed := fs.updated[path]
+	if !changed || current == etag {
+		fmt.Printf("%s changed while open, evicting etag %s\n", path, etag)
+		fs.stats.IncUpdateDetectedCount()
+
+		err := fs.cache.EvictFile(path, etag)
+		if err == nil {
+			fs.stats.IncFilesEvicted()
+		} else if err != NotInCache {
+			fs.updateLock.Unlock()
+			return nil, err
+		}
+
+		err = fs.cache.Invalidate(parent)
+		if err != nil && err != NotInCache {
+			fs.updateLock.Unlock()
+			return nil, err
+		}
+	}
+	fs.updateLock.Unlock()
+
+	// listing the directory goes to the backend, so other files' changes mustn't wait for it
+	stat, err := fs.statOf(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.updateLock.Lock()
+	defer fs.updateLock.Unlock()
+
+	if stat == nil {
+		fs.updated[path] = ""
+		return nil, nil
+	}
+	fs.updated[path] = stat.Etag
+	return stat, nil
+}
+
+// statOf returns the stat of the file at path from the listing of its directory, or nil if there is
+// no such file
+func (fs *FS) statOf(ctx context.Context, path string) (*FileStat, error) {
+	parent := parentPath(path)
+	files, err := fs.ListDir(ctx, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	stat := files.Get(strings.TrimPrefix(path[len(parent):], "/"))
+	if stat == nil || stat.IsDir {
+		return nil, nil
+	}
+	return stat, nil
+}
+
+// current returns the version of the file in the latest listing of its directory, which is newer
+// than the one the node was looked up with if the file has changed since
+func (f *File) current(ctx context.Context) (*FileStat, error) {
+	stat, err := f.fs.statOf(ctx, f.path)
+	if err != nil {
+		return nil, err
+	}
+	if stat == nil {
+		return nil, fuse.ENOENT
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.etag = stat.Etag
+	f.size = stat.Size
+	f.checksum = stat.Checksum
+	return stat, nil
+}
+
+func (fs *FS) handleOpened(path string) {
+	fs.updateLock.Lock()
+	defer fs.updateLock.Unlock()
+
+	fs.handles[path]++
+}
+
+// handleReleased forgets the changes to path once no handle can still be reading an old version
+func (fs *FS) handleReleased(path string) {
+	fs.updateLock.Lock()
+	defer fs.updateLock.Unlock()
+
+	fs.handles[path]--
+	if fs.handles[path] <= 0 {
+		delete(fs.handles, path)
+		delete(fs.updated, path)
+	}
+}
+
+// listed brings the changes recorded for the files in path up to date with a new listing of it, so
+// that a version which has since been replaced again isn't mistaken for the current one.  Checksum
+// failures of versions which have been replaced are forgotten.
+func (fs *FS) listed(path string, files *DirEntries) {
+	fs.updateLock.Lock()
+	defer fs.updateLock.Unlock()
+
+	for child, failed := range fs.checksumFailures {
+		if parentPath(child) != path {
+			continue
+		}
+		stat := files.Get(strings.TrimPrefix(child[len(path):], "/"))
+		if stat == nil || stat.Etag != failed {
+			// replaced, so the new version gets a chance
+			delete(fs.checksumFailures, child)
+		}
+	}
+
+	for child := range fs.updated {
+		if parentPath(child) != path {
+			continue
+		}
+		name := strings.TrimPrefix(child[len(path):], "/")
+		stat := files.Get(name)
+		if stat == nil || stat.IsDir {
+			fs.updated[child] = ""
+		} else {
+			fs.updated[child] = stat.Etag
+		}
+	}
+}
+
+// changed applies the update policy to a handle whose file has changed.  Returns nil if the handle was
+// switched over to the new contents and the read can be retried.
+func (f *FileHandle) changed(ctx context.Context, etag string) error {
+	// other reads of the handle carry on while the directory is listed again
+	stat, err := f.fs.fileChanged(ctx, f.path, etag)
+	if err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.etag != etag {
+		// another read already reopened it
+		return nil
+	}
+	if stat != nil && stat.Etag == f.etag {
+		// the object is unchanged and only our copy was evicted, so start a new one
+		return f.openCopy(stat)
+	}
+	if f.fs.options.UpdatePolicy != UpdateReopen || stat == nil {
+		return UpdateDetected
+	}
+
+	err = f.openCopy(stat)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Reopened %s with etag %s\n", f.path, stat.Etag)
+	f.fs.stats.IncFilesReopened()
+	return nil
+}
+
+// openCopy switches the handle over to the cached copy of the version of the file described by stat,
+// creating an empty one if there isn't one.  The caller must hold f.lock.
+func (f *FileHandle) openCopy(stat *FileStat) error {
+	localPath, err := f.fs.cache.GetLocalFile(f.path, stat.Etag, stat.Size)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+
+	// reads of the old copy may still be in progress, so it stays open until the handle is released
+	f.retired = append(f.retired, f.file)
+	f.file = file
+	f.etag = stat.Etag
+	f.size = stat.Size
+	f.checksum = stat.Checksum
+	f.verified = make(map[uint64]bool)
+	f.readahead = &readahead{}
+	return nil
+}
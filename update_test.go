@@ -0,0 +1,240 @@
+package singleply
+
+import (
+	"os"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	. "gopkg.in/check.v1"
+)
+
+type UpdateSuite struct{}
+
+var _ = Suite(&UpdateSuite{})
+
+// changingConn serves a single file "dir/f" whose contents depend on its version, and which
+// refuses reads of any version but the current one
+type changingConn struct {
+	*recordingConn
+	version byte
+}
+
+func newChangingConn() *changingConn {
+	c := &changingConn{recordingConn: newRecordingConn()}
+	c.replace(1000)
+	return c
+}
+
+func (c *changingConn) replace(size uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.version++
+	c.files["f"] = &FileStat{Name: "f", Size: size, Etag: string('0' + c.version)}
+}
+
+func (c *changingConn) contentAt(version byte, offset uint64) byte {
+	return contentAt(offset) + version
+}
+
+func (c *changingConn) ListDir(ctx context.Context, path string, status StatusCallback) (*DirEntries, error) {
+	if path == "" {
+		return &DirEntries{Files: []*FileStat{{Name: "dir", IsDir: true}}}, nil
+	}
+	return c.recordingConn.ListDir(ctx, path, status)
+}
+
+func (c *changingConn) PrepareForRead(ctx context.Context, path string, etag string, localPath string, offset uint64, length uint64, status StatusCallback) (*Region, error) {
+	c.lock.Lock()
+	current := c.files["f"]
+	version := c.version
+	c.lock.Unlock()
+
+	if current == nil || current.Etag != etag {
+		return nil, UpdateDetected
+	}
+
+	buffer := make([]byte, length)
+	for i := range buffer {
+		buffer[i] = c.contentAt(version, offset+uint64(i))
+	}
+
+	f, err := os.OpenFile(localPath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	_, err = f.WriteAt(buffer, int64(offset))
+	if err != nil {
+		return nil, err
+	}
+	return &Region{offset, length}, nil
+}
+
+func openTestFile(c *C, fs *FS, path string) *FileHandle {
+	dir := &Dir{path: parentPath(path), fs: fs}
+	node, err := dir.Lookup(context.Background(), path[len(dir.path)+1:])
+	c.Assert(err, IsNil)
+	handle, err := node.(*File).Open(context.Background(), &fuse.OpenRequest{}, &fuse.OpenResponse{})
+	c.Assert(err, IsNil)
+	return handle.(*FileHandle)
+}
+
+func readAt(handle *FileHandle, offset int64, size int) ([]byte, error) {
+	resp := &fuse.ReadResponse{}
+	err := handle.Read(context.Background(), &fuse.ReadRequest{Offset: offset, Size: size}, resp)
+	return resp.Data, err
+}
+
+func (s *UpdateSuite) TestFailPolicy(c *C) {
+	conn := newChangingConn()
+	fs, cache := newTestFS(c, conn, &FSOptions{BlockSize: 100})
+	defer cache.Close()
+
+	handle := openTestFile(c, fs, "dir/f")
+	data, err := readAt(handle, 0, 10)
+	c.Assert(err, IsNil)
+	c.Assert(data[5], Equals, conn.contentAt(1, 5))
+
+	conn.replace(2000)
+	_, err = readAt(handle, 500, 10)
+	c.Assert(err, Equals, UpdateDetected)
+	c.Assert(errnoOf(err), Equals, fuse.ESTALE)
+
+	// the old copy is gone, so even bytes which were cached are not served from it
+	_, err = readAt(handle, 0, 10)
+	c.Assert(err, Equals, UpdateDetected)
+	c.Assert(fs.stats.UpdateDetectedCount, Equals, int32(1))
+
+	// the listing was refreshed, so opening the file again sees the new version
+	handle2 := openTestFile(c, fs, "dir/f")
+	c.Assert(handle2.size, Equals, uint64(2000))
+	data, err = readAt(handle2, 1500, 10)
+	c.Assert(err, IsNil)
+	c.Assert(data[0], Equals, conn.contentAt(2, 1500))
+}
+
+func (s *UpdateSuite) TestReopenPolicy(c *C) {
+	conn := newChangingConn()
+	fs, cache := newTestFS(c, conn, &FSOptions{BlockSize: 100, UpdatePolicy: UpdateReopen})
+	defer cache.Close()
+
+	handle := openTestFile(c, fs, "dir/f")
+	other := openTestFile(c, fs, "dir/f")
+	data, err := readAt(handle, 0, 10)
+	c.Assert(err, IsNil)
+	c.Assert(data[5], Equals, conn.contentAt(1, 5))
+
+	conn.replace(2000)
+	data, err = readAt(handle, 0, 10)
+	c.Assert(err, IsNil)
+	c.Assert(data[5], Equals, conn.contentAt(1, 5))
+
+	// a read which needs the backend notices the change and switches over to the new version
+	data, err = readAt(handle, 500, 10)
+	c.Assert(err, IsNil)
+	c.Assert(data[0], Equals, conn.contentAt(2, 500))
+	c.Assert(handle.size, Equals, uint64(2000))
+	data, err = readAt(handle, 0, 10)
+	c.Assert(err, IsNil)
+	c.Assert(data[5], Equals, conn.contentAt(2, 5))
+
+	// the other handle hasn't hit the backend, but still learns about the change
+	data, err = readAt(other, 0, 10)
+	c.Assert(err, IsNil)
+	c.Assert(data[5], Equals, conn.contentAt(2, 5))
+
+	c.Assert(fs.stats.UpdateDetectedCount, Equals, int32(1))
+	c.Assert(fs.stats.FilesReopened, Equals, int32(2))
+
+	// if the file is deleted there is nothing to switch to
+	conn.lock.Lock()
+	delete(conn.files, "f")
+	conn.lock.Unlock()
+	_, err = readAt(handle, 1800, 10)
+	c.Assert(err, Equals, UpdateDetected)
+}
+
+func (s *UpdateSuite) TestEvictedWhileOpen(c *C) {
+	for _, policy := range []UpdatePolicy{UpdateFail, UpdateReopen} {
+		conn := newChangingConn()
+		fs, cache := newTestFS(c, conn, &FSOptions{BlockSize: 100, UpdatePolicy: policy})
+
+		handle := openTestFile(c, fs, "dir/f")
+		_, err := readAt(handle, 0, 10)
+		c.Assert(err, IsNil)
+
+		// the object hasn't changed, so the handle just downloads it again
+		for i := 0; i < 2; i++ {
+			c.Assert(cache.EvictFile("dir/f", ""), IsNil)
+			data, err := readAt(handle, 0, 10)
+			c.Assert(err, IsNil)
+			c.Assert(data[5], Equals, conn.contentAt(1, 5))
+		}
+		c.Assert(handle.etag, Equals, "1")
+		c.Assert(fs.stats.FilesReopened, Equals, int32(0))
+		cache.Close()
+	}
+}
+
+func (s *UpdateSuite) TestChangedTwice(c *C) {
+	conn := newChangingConn()
+	fs, cache := newTestFS(c, conn, &FSOptions{BlockSize: 100})
+	defer cache.Close()
+
+	handle := openTestFile(c, fs, "dir/f")
+	_, err := readAt(handle, 0, 10)
+	c.Assert(err, IsNil)
+
+	conn.replace(2000)
+	_, err = readAt(handle, 500, 10)
+	c.Assert(err, Equals, UpdateDetected)
+
+	// a later listing supersedes the version the failed read saw
+	conn.replace(3000)
+	c.Assert(cache.Invalidate("dir"), IsNil)
+	handle2 := openTestFile(c, fs, "dir/f")
+	c.Assert(handle2.size, Equals, uint64(3000))
+	c.Assert(fs.changedSince("dir/f", "3"), Equals, false)
+	data, err := readAt(handle2, 2500, 10)
+	c.Assert(err, IsNil)
+	c.Assert(data[0], Equals, conn.contentAt(3, 2500))
+
+	_, err = readAt(handle, 0, 10)
+	c.Assert(err, Equals, UpdateDetected)
+}
+
+func (s *UpdateSuite) TestReopenCachedNode(c *C) {
+	conn := newChangingConn()
+	fs, cache := newTestFS(c, conn, &FSOptions{BlockSize: 100})
+	defer cache.Close()
+
+	// the kernel keeps the node it looked up and opens it again after the change
+	dir := &Dir{path: "dir", fs: fs}
+	node, err := dir.Lookup(context.Background(), "f")
+	c.Assert(err, IsNil)
+	file := node.(*File)
+	handle, err := file.Open(context.Background(), &fuse.OpenRequest{}, &fuse.OpenResponse{})
+	c.Assert(err, IsNil)
+	_, err = readAt(handle.(*FileHandle), 0, 10)
+	c.Assert(err, IsNil)
+
+	conn.replace(2000)
+	_, err = readAt(handle.(*FileHandle), 500, 10)
+	c.Assert(err, Equals, UpdateDetected)
+	c.Assert(handle.(*FileHandle).Release(context.Background(), &fuse.ReleaseRequest{}), IsNil)
+
+	// once nothing has the file open, the change is forgotten
+	c.Assert(fs.updated, HasLen, 0)
+
+	handle, err = file.Open(context.Background(), &fuse.OpenRequest{}, &fuse.OpenResponse{})
+	c.Assert(err, IsNil)
+	data, err := readAt(handle.(*FileHandle), 1500, 10)
+	c.Assert(err, IsNil)
+	c.Assert(data[0], Equals, conn.contentAt(2, 1500))
+
+	attr := &fuse.Attr{}
+	c.Assert(file.Attr(context.Background(), attr), IsNil)
+	c.Assert(attr.Size, Equals, uint64(2000))
+}
@@ -0,0 +1,62 @@
+package singleply
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// walkFiles calls fn with each file at or below path, which may name a file or a directory.  The
+// files below a directory are only visited if recursive is set.  Listings come through the cache
+// like any other lookup.
+func (fs *FS) walkFiles(ctx context.Context, path string, recursive bool, fn func(path string, stat *FileStat) error) error {
+	path = strings.Trim(path, "/")
+	if path != "" {
+		parent := parentPath(path)
+		files, err := fs.ListDir(ctx, parent)
+		if err != nil {
+			return err
+		}
+
+		stat := files.Get(strings.TrimPrefix(path[len(parent):], "/"))
+		if stat == nil {
+			return &BackendError{Kind: BackendNotFound, Path: path}
+		}
+		if !stat.IsDir {
+			return fn(path, stat)
+		}
+	}
+
+	if !recursive {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	return fs.walkDir(ctx, path, fn)
+}
+
+func (fs *FS) walkDir(ctx context.Context, path string, fn func(path string, stat *FileStat) error) error {
+	files, err := fs.ListDir(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	for _, stat := range files.Files {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		childPath := stat.Name
+		if path != "" {
+			childPath = path + "/" + stat.Name
+		}
+		if stat.IsDir {
+			err = fs.walkDir(ctx, childPath, fn)
+		} else {
+			err = fn(childPath, stat)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}